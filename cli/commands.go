@@ -1,8 +1,12 @@
 package cli
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	helper "github.com/Gcaufy/freedb/helper"
 	kv "github.com/Gcaufy/freedb/kv"
@@ -46,6 +50,28 @@ func (c *cli) set(args []string) {
 		c.output(record)
 	})
 }
+func (c *cli) mset(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	if len(args)%2 != 0 {
+		c.log.Error("Command \"MSET\" expect key value pairs, but %d arguments got.", len(args))
+		return
+	}
+	c.timeUse(func() {
+		batch := c.kv.Batch()
+		for i := 0; i < len(args); i += 2 {
+			batch.Set(args[i], args[i+1])
+		}
+		record, err := batch.Exec()
+		if err != nil {
+			c.log.Error(err.Error())
+			return
+		}
+		c.output(record)
+	})
+}
 func (c *cli) append(args []string) {
 	if c.kv == nil || c.conf.host == nil {
 		c.log.Error("Please config your host first")
@@ -65,9 +91,18 @@ func (c *cli) get(args []string) {
 		c.log.Error("Please config your host first")
 		return
 	}
+	if len(args) != 1 && (len(args) != 3 || strings.ToUpper(args[1]) != "AT") {
+		c.log.Error("Command \"GET\" expect \"GET key\" or \"GET key AT rev\".")
+		return
+	}
 	c.timeUse(func() {
-
-		record, err := c.kv.Get(args[0])
+		var record *kv.KeyRecord
+		var err error
+		if len(args) == 3 {
+			record, err = c.kv.GetAt(args[0], args[2])
+		} else {
+			record, err = c.kv.Get(args[0])
+		}
 
 		if err != nil {
 			c.log.Error(fmt.Sprintln(err))
@@ -80,6 +115,48 @@ func (c *cli) get(args []string) {
 		c.output(record)
 	})
 }
+func (c *cli) history(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	c.timeUse(func() {
+		history, err := c.kv.History(args[0])
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+			return
+		}
+		c.outputHistory(history)
+	})
+}
+func (c *cli) revert(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	c.timeUse(func() {
+		record, err := c.kv.Revert(args[0], args[1])
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+			return
+		}
+		c.output(record)
+	})
+}
+func (c *cli) restore(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	c.timeUse(func() {
+		record, err := c.kv.RestoreDatabase(args[0])
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+			return
+		}
+		c.output(record)
+	})
+}
 func (c *cli) delete(args []string) {
 	if c.kv == nil || c.conf.host == nil {
 		c.log.Error("Please config your host first")
@@ -100,6 +177,95 @@ func (c *cli) delete(args []string) {
 	})
 }
 
+func (c *cli) rotateKey(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	if len(args) == 3 && strings.ToUpper(args[2]) != "DRYRUN" || len(args) > 3 {
+		c.log.Error("Command \"ROTATEKEY\" expect \"ROTATEKEY old new\" or \"ROTATEKEY old new DRYRUN\".")
+		return
+	}
+	c.timeUse(func() {
+		rotation, err := c.kv.RotateSecret(args[0], args[1], len(args) == 3)
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+			return
+		}
+		if !rotation.DryRun {
+			c.conf.secret = args[1]
+		}
+		b, err := json.MarshalIndent(rotation, "", "  ")
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+			return
+		}
+		fmt.Println(string(b))
+	})
+}
+
+func (c *cli) sync(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	c.timeUse(func() {
+		result, err := c.kv.Sync()
+		if result != nil {
+			b, marshalErr := json.MarshalIndent(result, "", "  ")
+			if marshalErr != nil {
+				c.log.Error(fmt.Sprintln(marshalErr))
+				return
+			}
+			fmt.Println(string(b))
+		}
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+		}
+	})
+}
+
+// status is the output of STATUS
+type status struct {
+	Host      string        `json:"host"`
+	DB        string        `json:"db"`
+	Branch    string        `json:"branch"`
+	RateLimit *kv.RateLimit `json:"rate_limit,omitempty"`
+}
+
+func (c *cli) status(args []string) {
+	if c.kv == nil || c.conf.host == nil {
+		c.log.Error("Please config your host first")
+		return
+	}
+	c.timeUse(func() {
+		st := &status{
+			Host:   strings.Trim(strings.Join([]string{c.conf.host.Provider, c.conf.host.User, c.conf.host.Repo}, "/"), "/"),
+			DB:     c.conf.db,
+			Branch: c.conf.branch,
+		}
+		rl, err := c.kv.RateLimit()
+		if err == nil {
+			st.RateLimit = rl
+		}
+		if c.conf.shortOutput {
+			if rl != nil && rl.Limit > 0 {
+				fmt.Printf("%d/%d, reset at %s\n", rl.Remaining, rl.Limit, rl.Reset.Format(time.RFC3339))
+			}
+		} else {
+			b, marshalErr := json.MarshalIndent(st, "", "  ")
+			if marshalErr != nil {
+				c.log.Error(fmt.Sprintln(marshalErr))
+				return
+			}
+			fmt.Println(string(b))
+		}
+		if err != nil {
+			c.log.Error(fmt.Sprintln(err))
+		}
+	})
+}
+
 func (c *cli) config(args []string) {
 	item, value := strings.ToUpper(args[0]), args[1]
 	switch item {
@@ -112,6 +278,10 @@ func (c *cli) config(args []string) {
 		if c.conf.host == nil || c.conf.host.Provider != host.Provider {
 			c.conf.host = host
 			c.kv, err = kv.NewKV(value, c.conf.token)
+			if err != nil {
+				c.log.Error(err.Error())
+				return
+			}
 			if c.conf.db != "" {
 				c.kv.Use(c.conf.db)
 			}
@@ -121,14 +291,28 @@ func (c *cli) config(args []string) {
 			if c.conf.secret != "" {
 				c.kv.SetSecret(c.conf.secret)
 			}
-			if err != nil {
+			if c.conf.apiURL != "" {
+				c.kv.SetAPIURL(c.conf.apiURL)
+			}
+			c.kv.SetCacheMode(c.conf.cache)
+			c.kv.SetOffline(c.conf.offline)
+			if err := c.applyDiskCache(); err != nil {
 				c.log.Error(err.Error())
-				return
 			}
+			if err := c.applyJournal(); err != nil {
+				c.log.Error(err.Error())
+			}
+			c.applyHTTPClient()
 		} else {
 			c.kv.SetHost(value)
 		}
 		break
+	case "API":
+		c.conf.apiURL = value
+		if c.kv != nil {
+			c.kv.SetAPIURL(value)
+		}
+		break
 	case "TOKEN":
 		c.conf.token = value
 		if c.kv != nil {
@@ -150,19 +334,126 @@ func (c *cli) config(args []string) {
 	case "CACHE":
 		s := strings.ToUpper(value)
 		if s == "FALSE" {
-			c.conf.cache = false
-			if c.kv != nil {
-				c.kv.UseCache = false
-				c.kv.ClearCache()
-			}
+			c.conf.cache = kv.CacheNever
 		} else if s == "TRUE" {
-			c.conf.cache = true
-			if c.kv != nil {
-				c.kv.UseCache = true
+			c.conf.cache = kv.CacheAlways
+		} else if s == "REVALIDATE" {
+			c.conf.cache = kv.CacheRevalidate
+		} else {
+			c.log.Error("CACHE is TRUE, FALSE or REVALIDATE")
+			return
+		}
+		if c.kv != nil {
+			c.kv.SetCacheMode(c.conf.cache)
+		}
+		break
+	case "CACHEDIR":
+		c.conf.cacheDir = value
+		if err := c.applyDiskCache(); err != nil {
+			c.log.Error(err.Error())
+		}
+		break
+	case "CACHETTL":
+		if _, err := time.ParseDuration(value); err != nil {
+			c.log.Error(err.Error())
+			return
+		}
+		c.conf.cacheTTL = value
+		if err := c.applyDiskCache(); err != nil {
+			c.log.Error(err.Error())
+		}
+		break
+	case "JOURNAL":
+		c.conf.journal = value
+		if err := c.applyJournal(); err != nil {
+			c.log.Error(err.Error())
+		}
+		break
+	case "OFFLINE":
+		c.conf.offline = strings.ToUpper(value) == "TRUE"
+		if c.kv != nil {
+			c.kv.SetOffline(c.conf.offline)
+		}
+		break
+	case "TIMEOUT":
+		if _, err := time.ParseDuration(value); err != nil {
+			c.log.Error(err.Error())
+			return
+		}
+		c.conf.timeout = value
+		c.applyHTTPClient()
+		break
+	case "PROXY":
+		if s := strings.ToUpper(value); s != "OFF" && s != "DEFAULT" {
+			if u, err := url.Parse(value); err != nil || u.Host == "" {
+				c.log.Error("PROXY is a URL, e.g. http://proxy.example:3128, OFF or DEFAULT")
+				return
 			}
 		}
+		c.conf.proxy = value
+		c.applyHTTPClient()
 		break
 	default:
 		c.log.Error("CONFIG command does not recognize key: " + item)
 	}
 }
+
+// applyDiskCache sets the disk cache of the KV from the config
+func (c *cli) applyDiskCache() error {
+	if c.kv == nil {
+		return nil
+	}
+	dir := c.conf.cacheDir
+	if dir == "" || strings.ToUpper(dir) == "OFF" {
+		c.kv.DisableDiskCache()
+		return nil
+	}
+	if strings.ToUpper(dir) == "DEFAULT" {
+		dir = ""
+	}
+	var ttl time.Duration
+	if c.conf.cacheTTL != "" {
+		ttl, _ = time.ParseDuration(c.conf.cacheTTL)
+	}
+	return c.kv.SetDiskCache(dir, ttl)
+}
+
+// applyJournal sets the write journal of the KV from the config
+func (c *cli) applyJournal() error {
+	if c.kv == nil {
+		return nil
+	}
+	dir := c.conf.journal
+	if dir == "" || strings.ToUpper(dir) == "OFF" {
+		c.kv.DisableJournal()
+		return nil
+	}
+	if strings.ToUpper(dir) == "DEFAULT" {
+		dir = ""
+	}
+	return c.kv.SetJournal(dir)
+}
+
+// applyHTTPClient sets the http client of the KV from the timeout and proxy of the config
+func (c *cli) applyHTTPClient() {
+	if c.kv == nil {
+		return
+	}
+	proxy := strings.ToUpper(c.conf.proxy)
+	if c.conf.timeout == "" && (proxy == "" || proxy == "DEFAULT") {
+		c.kv.SetHTTPClient(nil)
+		return
+	}
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if proxy == "OFF" {
+		transport.Proxy = nil
+	} else if proxy != "" && proxy != "DEFAULT" {
+		proxyURL, _ := url.Parse(c.conf.proxy)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	client := &http.Client{Transport: transport}
+	if c.conf.timeout != "" {
+		client.Timeout, _ = time.ParseDuration(c.conf.timeout)
+	}
+	c.kv.SetHTTPClient(client)
+}
@@ -16,24 +16,66 @@ var commandInstruct = []*instruct{
 		text: "DELETE", desc: "Delete a key",
 	},
 	&instruct{
-		text: "GET", desc: "Get the value of a key",
+		text: "GET", desc: "Get the value of a key, GET key AT rev reads it at a commit, tag or time",
+	},
+	&instruct{
+		text: "HISTORY", desc: "List the commits of a key",
+	},
+	&instruct{
+		text: "REVERT", desc: "Write a key back to its value at a commit, tag or time",
+	},
+	&instruct{
+		text: "RESTORE", desc: "Write the database back to its state at a commit, tag or time",
 	},
 	&instruct{
 		text: "SET", desc: "Set value to a key",
 	},
+	&instruct{
+		text: "MSET", desc: "Set values to several keys in one commit",
+	},
 	&instruct{
 		text: "KEYS", desc: "List all keys",
 	},
+	&instruct{
+		text: "ROTATEKEY", desc: "Re-encrypt the database with a new secret, ROTATEKEY old new [DRYRUN]",
+	},
+	&instruct{
+		text: "STATUS", desc: "Show the host, database, branch and the remaining rate limit",
+	},
+	&instruct{
+		text: "SYNC", desc: "Replay the journaled writes and report conflicts",
+	},
 	&instruct{
 		text: "USE", desc: "Change database",
 	},
 }
 var configInstruct = []*instruct{
 	&instruct{
-		text: "CACHE", desc: "Cache query result",
+		text: "CACHE", desc: "Cache query result, TRUE, FALSE or REVALIDATE with conditional requests",
+	},
+	&instruct{
+		text: "CACHEDIR", desc: "Disk cache folder, DEFAULT for the user cache dir or OFF",
+	},
+	&instruct{
+		text: "CACHETTL", desc: "How long the disk cache is read without querying, e.g. 10m",
+	},
+	&instruct{
+		text: "OFFLINE", desc: "Read the disk cache when the host can not be reached, TRUE or FALSE",
 	},
 	&instruct{
-		text: "HOST", desc: "It's a https/ssh git clone link",
+		text: "JOURNAL", desc: "Journal folder of the writes made offline, DEFAULT for the user cache dir or OFF",
+	},
+	&instruct{
+		text: "TIMEOUT", desc: "Timeout of every request to the host, e.g. 30s, 0 for none",
+	},
+	&instruct{
+		text: "PROXY", desc: "Proxy URL of the requests to the host, OFF for none or DEFAULT for HTTPS_PROXY",
+	},
+	&instruct{
+		text: "HOST", desc: "It's a https/ssh git clone link or a local repository path",
+	},
+	&instruct{
+		text: "API", desc: "API base URL of the host, for GitHub Enterprise or Gitea",
 	},
 	&instruct{
 		text: "TOKEN", desc: "Git OAuth access token",
@@ -45,7 +87,9 @@ var configInstruct = []*instruct{
 
 type dslInstruct struct {
 	args int
-	exec func(args []string)
+	// variadic commands take args or more arguments
+	variadic bool
+	exec     func(args []string)
 }
 
 var dslInstructs = make(map[string]*dslInstruct)
@@ -56,9 +100,27 @@ func (c *cli) initDSL() {
 		exec: c.set,
 	}
 
+	dslInstructs["MSET"] = &dslInstruct{
+		args:     2,
+		variadic: true,
+		exec:     c.mset,
+	}
 	dslInstructs["GET"] = &dslInstruct{
+		args:     1,
+		variadic: true,
+		exec:     c.get,
+	}
+	dslInstructs["HISTORY"] = &dslInstruct{
 		args: 1,
-		exec: c.get,
+		exec: c.history,
+	}
+	dslInstructs["REVERT"] = &dslInstruct{
+		args: 2,
+		exec: c.revert,
+	}
+	dslInstructs["RESTORE"] = &dslInstruct{
+		args: 1,
+		exec: c.restore,
 	}
 	dslInstructs["APPEND"] = &dslInstruct{
 		args: 2,
@@ -72,6 +134,19 @@ func (c *cli) initDSL() {
 		args: 2,
 		exec: c.config,
 	}
+	dslInstructs["ROTATEKEY"] = &dslInstruct{
+		args:     2,
+		variadic: true,
+		exec:     c.rotateKey,
+	}
+	dslInstructs["STATUS"] = &dslInstruct{
+		args: 0,
+		exec: c.status,
+	}
+	dslInstructs["SYNC"] = &dslInstruct{
+		args: 0,
+		exec: c.sync,
+	}
 	dslInstructs["USE"] = &dslInstruct{
 		args: 1,
 		exec: c.use,
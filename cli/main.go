@@ -17,12 +17,19 @@ import (
 type Config struct {
 	host        *helper.Host
 	hostStr     string
+	apiURL      string
 	token       string
 	db          string
 	branch      string
 	execute     string
 	shortOutput bool
-	cache       bool
+	cache       kv.CacheMode
+	cacheDir    string
+	cacheTTL    string
+	offline     bool
+	journal     string
+	timeout     string
+	proxy       string
 	secret      string
 }
 
@@ -41,7 +48,7 @@ func Run() {
 		conf: &Config{
 			db:     "default",
 			branch: "master",
-			cache:  true,
+			cache:  kv.CacheAlways,
 		},
 	}
 
@@ -65,6 +72,27 @@ func (c *cli) initCLI() {
 					c.execLine(fmt.Sprintf("CONFIG %s %s", strings.ToUpper(item), v))
 				}
 			}
+			if c.conf.apiURL != "" {
+				c.execLine("CONFIG API " + c.conf.apiURL)
+			}
+			if c.conf.cacheDir != "" {
+				c.execLine("CONFIG CACHEDIR " + c.conf.cacheDir)
+			}
+			if c.conf.cacheTTL != "" {
+				c.execLine("CONFIG CACHETTL " + c.conf.cacheTTL)
+			}
+			if c.conf.journal != "" {
+				c.execLine("CONFIG JOURNAL " + c.conf.journal)
+			}
+			if c.conf.offline {
+				c.execLine("CONFIG OFFLINE TRUE")
+			}
+			if c.conf.timeout != "" {
+				c.execLine("CONFIG TIMEOUT " + c.conf.timeout)
+			}
+			if c.conf.proxy != "" {
+				c.execLine("CONFIG PROXY " + c.conf.proxy)
+			}
 			if c.conf.hostStr != "" {
 				c.execLine("CONFIG HOST " + c.conf.hostStr)
 			}
@@ -84,8 +112,15 @@ func (c *cli) initCLI() {
 	rootCmd.PersistentFlags().StringVarP(&c.conf.branch, "branch", "b", "master", "Config using branch.")
 	rootCmd.PersistentFlags().StringVarP(&c.conf.token, "token", "t", "", "Access token for the git repository.")
 	rootCmd.PersistentFlags().StringVarP(&c.conf.secret, "key", "k", "", "Secret key for encrypt and decrypt.")
-	rootCmd.PersistentFlags().StringVarP(&c.conf.hostStr, "host", "h", "", "Connect to host, which is a https/ssh git clone link.")
+	rootCmd.PersistentFlags().StringVarP(&c.conf.hostStr, "host", "h", "", "Connect to host, which is a https/ssh git clone link or a local repository path.")
+	rootCmd.PersistentFlags().StringVarP(&c.conf.apiURL, "api", "a", "", "API base URL of the host, e.g. https://github.corp.example/api/v3.")
 	rootCmd.PersistentFlags().StringVarP(&c.conf.execute, "execute", "e", "", "Execute command and quit.")
+	rootCmd.PersistentFlags().StringVar(&c.conf.cacheDir, "cache-dir", "", "Keep read keys in a disk cache folder, DEFAULT is the user cache dir.")
+	rootCmd.PersistentFlags().StringVar(&c.conf.cacheTTL, "cache-ttl", "", "Read keys from the disk cache without querying while younger than it, e.g. 10m.")
+	rootCmd.PersistentFlags().StringVar(&c.conf.journal, "journal", "", "Journal writes when the host can not be reached in a folder, DEFAULT is the user cache dir, replay them with SYNC.")
+	rootCmd.PersistentFlags().BoolVar(&c.conf.offline, "offline", false, "Read keys from the disk cache when the host can not be reached.")
+	rootCmd.PersistentFlags().StringVar(&c.conf.timeout, "timeout", "", "Timeout of every request to the host, e.g. 30s.")
+	rootCmd.PersistentFlags().StringVar(&c.conf.proxy, "proxy", "", "Proxy URL of the requests to the host, OFF for none, DEFAULT is the HTTPS_PROXY environment variable.")
 	rootCmd.PersistentFlags().BoolVarP(&helpFlag, "help", "?", false, "Display the help")
 	rootCmd.PersistentFlags().BoolVarP(&c.conf.shortOutput, "short-output", "s", false, "Only output the value")
 
@@ -159,8 +194,10 @@ func (c *cli) execLine(line string) bool {
 
 	if commandName != nil {
 		argLen := len(args)
-		if commandName.args == argLen {
+		if commandName.args == argLen || (commandName.variadic && argLen > commandName.args) {
 			commandName.exec(args)
+		} else if commandName.variadic {
+			c.log.Error("Command \"%s\" expect at least %d arguments, but %d arguments got.", arg0, commandName.args, argLen)
 		} else {
 			c.log.Error("Command \"%s\" expect %d arguments, but %d arguments got.", arg0, commandName.args, argLen)
 		}
@@ -200,6 +237,21 @@ func (c *cli) output(kr *kv.KeyRecord) {
 	fmt.Println(val)
 }
 
+func (c *cli) outputHistory(history []*kv.Revision) {
+	if c.conf.shortOutput {
+		for _, revision := range history {
+			fmt.Printf("%s %s\n", revision.Commit, strings.SplitN(revision.Message, "\n", 2)[0])
+		}
+		return
+	}
+	b, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		c.log.Error(fmt.Sprintln(err))
+		return
+	}
+	fmt.Println(string(b))
+}
+
 func (c *cli) outputList(krl *[]*kv.KeyRecord) {
 	if len(*krl) == 0 {
 		fmt.Println("[]")
@@ -1,7 +1,14 @@
 package cli
 
-import "testing"
-import "os"
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	helper "github.com/Gcaufy/freedb/helper"
+	kv "github.com/Gcaufy/freedb/kv"
+)
 
 var host = "git@github.com:Gcaufy-Test/test-database.git"
 var token = os.Getenv("TEST_REPO_TOKEN")
@@ -20,10 +27,18 @@ func createCliInstance() *cli {
 	return c
 }
 
+// createMemoryCliInstance is a configured cli instance which needs no network access
+func createMemoryCliInstance() *cli {
+	c := createCliInstance()
+	c.conf.host = &helper.Host{Provider: "memory"}
+	c.conf.shortOutput = true
+	c.kv = kv.NewKVWithQuerier(kv.NewMemoryQuerier(nil, nil))
+	return c
+}
+
 func TestConfig(t *testing.T) {
 	if token == "" {
-		t.Error("Token is not set")
-		return
+		t.Skip("TEST_REPO_TOKEN is not set")
 	}
 	c.execLine("CONFIG HOST " + host)
 	c.execLine("CONFIG TOKEN " + token)
@@ -35,11 +50,75 @@ func TestConfig(t *testing.T) {
 func TestCommandBeforeConfig(t *testing.T) {
 	c := createCliInstance()
 	if token == "" {
-		t.Error("Token is not set")
-		return
+		t.Skip("TEST_REPO_TOKEN is not set")
 	}
 	c.execLine("APPEND abc 123")
 	c.execLine("SET abc 123")
 	c.execLine("GET abc")
 	c.execLine("KEYS")
 }
+
+func TestMemoryCommands(t *testing.T) {
+	c := createMemoryCliInstance()
+	c.execLine("USE golang; SET abc 123; APPEND abc 456; SET def 789; DELETE def")
+	c.execLine("MSET x 1 y 2; MSET z")
+
+	record, err := c.kv.Get("abc")
+	if err != nil || record.Content != "123456" {
+		t.Errorf("expect 123456, got %v %v", record, err)
+	}
+	list, err := c.kv.Keys()
+	if err != nil || len(*list) != 3 {
+		t.Errorf("expect 3 keys, got %v %v", list, err)
+	}
+
+	history, err := c.kv.History("abc")
+	if err != nil || len(history) != 2 {
+		t.Fatalf("expect 2 commits, got %v %v", history, err)
+	}
+	c.execLine("HISTORY abc; GET abc AT " + history[1].Commit + "; GET abc FROM x")
+	c.execLine("REVERT abc " + history[1].Commit + "; RESTORE " + history[1].Commit)
+	if record, _ = c.kv.Get("abc"); record.Content != "123" {
+		t.Errorf("expect abc to be reverted, got %s", record.Content)
+	}
+	if list, _ = c.kv.Keys(); len(*list) != 1 {
+		t.Errorf("expect the database to be restored, got %v", list)
+	}
+}
+
+func TestMemoryRotateKey(t *testing.T) {
+	c := createMemoryCliInstance()
+	c.conf.secret = "old"
+	c.kv.SetSecret("old")
+	c.execLine("SET abc 123; ROTATEKEY old new DRYRUN; ROTATEKEY wrong new")
+	if c.conf.secret != "old" {
+		t.Errorf("expect the secret to be kept, got %s", c.conf.secret)
+	}
+	c.execLine("ROTATEKEY old new")
+	if c.conf.secret != "new" {
+		t.Errorf("expect the new secret, got %s", c.conf.secret)
+	}
+	if record, err := c.kv.Get("abc"); err != nil || record.Content != "123" {
+		t.Errorf("expect 123, got %v %v", record, err)
+	}
+}
+
+func TestMemoryHTTPClient(t *testing.T) {
+	c := createMemoryCliInstance()
+	querier := kv.NewMemoryQuerier(nil, nil)
+	c.kv = kv.NewKVWithQuerier(querier)
+	c.execLine("CONFIG TIMEOUT 5s; CONFIG PROXY http://proxy.example:3128; CONFIG PROXY nowhere")
+	client := querier.Option().HTTPClient
+	if client == nil || client.Timeout != 5*time.Second {
+		t.Fatalf("expect a client with a 5s timeout, got %v", client)
+	}
+	req, _ := http.NewRequest("GET", "https://api.github.com", nil)
+	if proxy, err := client.Transport.(*http.Transport).Proxy(req); err != nil || proxy.Host != "proxy.example:3128" {
+		t.Errorf("expect proxy.example:3128, got %v %v", proxy, err)
+	}
+
+	c.execLine("CONFIG TIMEOUT 0s; CONFIG PROXY OFF")
+	if client = querier.Option().HTTPClient; client.Timeout != 0 || client.Transport.(*http.Transport).Proxy != nil {
+		t.Errorf("expect no timeout and no proxy, got %v", client)
+	}
+}
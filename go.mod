@@ -1,6 +1,6 @@
 module github.com/Gcaufy/freedb
 
-go 1.12
+go 1.13
 
 require (
 	github.com/c-bata/go-prompt v0.2.3
@@ -9,4 +9,5 @@ require (
 	github.com/mattn/go-tty v0.0.0-20190424173100-523744f04859 // indirect
 	github.com/pkg/term v0.0.0-20190109203006-aa71e9d9e942 // indirect
 	github.com/spf13/cobra v0.0.5
+	golang.org/x/crypto v0.0.0-20181203042331-505ab145d0a9
 )
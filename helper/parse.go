@@ -2,7 +2,9 @@ package helper
 
 import (
 	"errors"
+	"path/filepath"
 	"regexp"
+	"strings"
 )
 
 // Host is github host struct
@@ -12,11 +14,28 @@ type Host struct {
 	Repo     string
 }
 
+// LocalProvider is the provider of a local git repository, whose Repo is the repository path
+const LocalProvider = "file"
+
 // ParseHost is a function to parse git@github.com:xx/yy.git or https://github.com/xxx/yyy.git
+// https links may carry a user name like bitbucket does: https://user@bitbucket.org/xxx/yyy.git
+// and a port like self-hosted gitea often does: https://gitea.example.com:3000/xxx/yyy.git,
+// the port is kept in Provider
+// A local repository can be given as file:///path/to/repo.git or an absolute path
 func ParseHost(host string) (*Host, error) {
+	if strings.HasPrefix(host, "file://") || filepath.IsAbs(host) {
+		path := filepath.Clean(strings.TrimPrefix(host, "file://"))
+		if !filepath.IsAbs(path) {
+			return nil, errors.New("Local repository should be an absolute path: " + host)
+		}
+		return &Host{
+			Provider: LocalProvider,
+			Repo:     path,
+		}, nil
+	}
 	regs := [2]*regexp.Regexp{
-		regexp.MustCompile(`git@([\w\.]+):([\w_-]+)\/([\w\._-]+)\.git`),
-		regexp.MustCompile(`https:\/\/([\w\.]+)\/([\w_-]+)\/([\w\._-]+)\.git`),
+		regexp.MustCompile(`git@([\w\.-]+):([\w_-]+)\/([\w\._-]+)\.git`),
+		regexp.MustCompile(`https:\/\/(?:[\w\.-]+@)?([\w\.-]+(?::\d+)?)\/([\w_-]+)\/([\w\._-]+)\.git`),
 	}
 
 	for _, reg := range regs {
@@ -33,3 +33,49 @@ func TestParseError(t *testing.T) {
 		t.Error("Expect parse error")
 	}
 }
+
+func TestParseHostWithUser(t *testing.T) {
+	host, err := ParseHost("https://Gcaufy@bitbucket.org/Gcaufy-Test/testdb.git")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if host.Provider != "bitbucket.org" || host.User != "Gcaufy-Test" || host.Repo != "testdb" {
+		t.Errorf("unexpected host: %+v", host)
+	}
+}
+
+func TestParseLocalHost(t *testing.T) {
+	hostFile, errf := ParseHost("file:///tmp/testdb.git")
+	hostPath, errp := ParseHost("/tmp/testdb.git/")
+
+	if errf != nil || errp != nil {
+		t.Error(errf)
+		t.Error(errp)
+		return
+	}
+	if hostFile.Provider != LocalProvider || hostFile.Repo != "/tmp/testdb.git" || *hostFile != *hostPath {
+		t.Errorf("unexpected host: %+v %+v", hostFile, hostPath)
+	}
+	if _, err := ParseHost("file://tmp/testdb.git"); err == nil {
+		t.Error("Expect parse error")
+	}
+}
+
+func TestParseSelfHostedHost(t *testing.T) {
+	tests := map[string]string{
+		"git@gitea.my-corp.com:team/repo.git":               "gitea.my-corp.com",
+		"https://gitea.example.com:3000/team/repo.git":      "gitea.example.com:3000",
+		"https://user@gitea.my-corp.com:3000/team/repo.git": "gitea.my-corp.com:3000",
+	}
+	for link, provider := range tests {
+		host, err := ParseHost(link)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if host.Provider != provider || host.User != "team" || host.Repo != "repo" {
+			t.Errorf("unexpected host for %s: %+v", link, host)
+		}
+	}
+}
@@ -4,23 +4,111 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"io"
 )
 
+// formatGCM is the header byte of data sealed with AES-GCM,
+// data without it is in the legacy AES-CBC format
+const formatGCM byte = 1
+
+var errDecrypt = errors.New("message authentication failed")
+
+// encrypt seals src with a random nonce, the output is
+// hex(formatGCM | nonce | ciphertext | tag). The output only opens with the
+// same aad, which binds it to where it is stored.
+func encrypt(src string, key string, aad string) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return seal(aead, nonce, src, aad), nil
+}
+
+// encryptName seals src with a nonce derived from src, so the same name
+// always gives the same output and a key can be found by its encrypted name
+func encryptName(src string, key string) string {
+	aead, _ := newGCM(key)
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(src))
+	return seal(aead, mac.Sum(nil)[:aead.NonceSize()], src, "")
+}
+
+func seal(aead cipher.AEAD, nonce []byte, src string, aad string) string {
+	out := append([]byte{formatGCM}, nonce...)
+	out = aead.Seal(out, nonce, []byte(src), additionalData(aad))
+	return hex.EncodeToString(out)
+}
+
+// additionalData authenticates the format byte along with aad
+func additionalData(aad string) []byte {
+	return append([]byte{formatGCM}, aad...)
+}
+
+// decrypt opens the AES-GCM format sealed with aad
+func decrypt(src string, key string, aad string) (string, error) {
+	bs, err := hex.DecodeString(src)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(bs) < 1+aead.NonceSize()+aead.Overhead() || bs[0] != formatGCM {
+		return "", errDecrypt
+	}
+	nonce := bs[1 : 1+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, bs[1+aead.NonceSize():], additionalData(aad))
+	if err != nil {
+		return "", errDecrypt
+	}
+	return string(plain), nil
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
 func padding(src []byte, blocksize int) []byte {
 	padnum := blocksize - len(src)%blocksize
 	pad := bytes.Repeat([]byte{byte(padnum)}, padnum)
 	return append(src, pad...)
 }
 
-func unpadding(src []byte) []byte {
+func unpadding(src []byte, blocksize int) ([]byte, error) {
 	n := len(src)
+	if n == 0 {
+		return nil, errDecrypt
+	}
 	unpadnum := int(src[n-1])
-	return src[:n-unpadnum]
+	if unpadnum == 0 || unpadnum > blocksize || unpadnum > n {
+		return nil, errDecrypt
+	}
+	for _, b := range src[n-unpadnum:] {
+		if int(b) != unpadnum {
+			return nil, errDecrypt
+		}
+	}
+	return src[:n-unpadnum], nil
 }
 
-func encrypt(src string, key string) string {
+// legacyEncrypt is the AES-CBC format written by older versions, which uses
+// the key as IV. It is only used to find keys written by them.
+func legacyEncrypt(src string, key string) string {
 	bs := []byte(src)
 	bk := []byte(key)
 	block, _ := aes.NewCipher(bk)
@@ -31,14 +119,29 @@ func encrypt(src string, key string) string {
 	return hex.EncodeToString(bs)
 }
 
-func decrypt(src string, key string) string {
-	bs, _ := hex.DecodeString(src)
+// legacyDecrypt opens the AES-CBC format of older versions, which is not
+// authenticated: a wrong key may give garbage instead of an error
+func legacyDecrypt(src string, key string) (string, error) {
+	bs, err := hex.DecodeString(src)
+	if err != nil {
+		return "", err
+	}
 	bk := []byte(key)
-	block, _ := aes.NewCipher(bk)
+	block, err := aes.NewCipher(bk)
+	if err != nil {
+		return "", err
+	}
+	// Only AES-128 keys can be used as IV
+	if len(bk) != block.BlockSize() || len(bs) == 0 || len(bs)%block.BlockSize() != 0 {
+		return "", errDecrypt
+	}
 	blockmode := cipher.NewCBCDecrypter(block, bk)
 	blockmode.CryptBlocks(bs, bs)
-	bs = unpadding(bs)
-	return string(bs)
+	bs, err = unpadding(bs, block.BlockSize())
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
 }
 
 func toMD5(s string) string {
@@ -0,0 +1,53 @@
+package kv
+
+import "testing"
+
+func TestEncrypt(t *testing.T) {
+	key := toMD5("secret")
+	first, err := encrypt("value", key, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := encrypt("value", key, "name")
+	if first == second {
+		t.Error("expect a random nonce")
+	}
+	if plain, err := decrypt(first, key, "name"); err != nil || plain != "value" {
+		t.Errorf("expect value, got %s %v", plain, err)
+	}
+	if encryptName("key", key) != encryptName("key", key) {
+		t.Error("expect names to be deterministic")
+	}
+	if plain, err := decrypt(encryptName("key", key), key, ""); err != nil || plain != "key" {
+		t.Errorf("expect key, got %s %v", plain, err)
+	}
+
+	tampered := []byte(first)
+	tampered[len(tampered)-1] ^= 1
+	if _, err = decrypt(string(tampered), key, "name"); err == nil {
+		t.Error("expect a tampered value to fail")
+	}
+	if _, err = decrypt(first, toMD5("other"), "name"); err == nil {
+		t.Error("expect a wrong secret to fail")
+	}
+	if _, err = decrypt(first, key, "other"); err == nil {
+		t.Error("expect a value moved to another name to fail")
+	}
+	for _, bad := range []string{"", "zz", "00", "0100"} {
+		if _, err = decrypt(bad, key, "name"); err == nil {
+			t.Errorf("expect %q to fail", bad)
+		}
+	}
+}
+
+func TestLegacyDecrypt(t *testing.T) {
+	key := toMD5("secret")
+	// Written by older versions with AES-CBC
+	legacy := legacyEncrypt("value", key)
+	if plain, err := legacyDecrypt(legacy, key); err != nil || plain != "value" {
+		t.Errorf("expect value, got %s %v", plain, err)
+	}
+	if _, err := legacyDecrypt(legacy[:len(legacy)-2], key); err == nil {
+		t.Error("expect a truncated value to fail")
+	}
+}
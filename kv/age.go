@@ -0,0 +1,196 @@
+package kv
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	ageRecipientPrefix = "age"
+	ageIdentityPrefix  = "AGE-SECRET-KEY-"
+	ageX25519Label     = "age-encryption.org/v1/X25519"
+)
+
+// ageProvider wraps the data key for X25519 recipients the way age does,
+// so keys made with age-keygen can be used
+type ageProvider struct {
+	recipients map[string][32]byte
+	identities [][32]byte
+}
+
+// NewAgeProvider creates a KeyProvider from an age recipients file, one
+// "age1..." public key per line, and an age identity file holding
+// "AGE-SECRET-KEY-1..." private keys. The data key is wrapped for every
+// recipient and unwrapped with any identity. Either file may be empty, without
+// recipients the data key is wrapped for the identities.
+func NewAgeProvider(recipientsFile string, identityFile string) (KeyProvider, error) {
+	p := &ageProvider{recipients: make(map[string][32]byte)}
+	if identityFile != "" {
+		lines, err := readKeyLines(identityFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			identity, err := parseAgeKey(line, strings.ToLower(ageIdentityPrefix))
+			if err != nil {
+				return nil, err
+			}
+			p.identities = append(p.identities, identity)
+		}
+	}
+	if recipientsFile != "" {
+		lines, err := readKeyLines(recipientsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range lines {
+			recipient, err := parseAgeKey(line, ageRecipientPrefix)
+			if err != nil {
+				return nil, err
+			}
+			p.recipients[strings.ToLower(line)] = recipient
+		}
+	} else {
+		for _, identity := range p.identities {
+			id, recipient := ageRecipient(identity)
+			p.recipients[id] = recipient
+		}
+	}
+	if len(p.recipients) == 0 && len(p.identities) == 0 {
+		return nil, fmt.Errorf("No age recipient or identity found")
+	}
+	return p, nil
+}
+
+// readKeyLines returns the lines of a key file, without blanks and comments
+func readKeyLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func parseAgeKey(s string, hrp string) ([32]byte, error) {
+	var key [32]byte
+	prefix, data, err := bech32Decode(s)
+	if err != nil {
+		return key, err
+	}
+	if prefix != hrp || len(data) != 32 {
+		return key, fmt.Errorf("Invalid age key \"%s\"", s)
+	}
+	copy(key[:], data)
+	return key, nil
+}
+
+// ageRecipient returns the public key of an identity and its "age1..." string
+func ageRecipient(identity [32]byte) (string, [32]byte) {
+	var recipient [32]byte
+	curve25519.ScalarBaseMult(&recipient, &identity)
+	id, _ := bech32Encode(ageRecipientPrefix, recipient[:])
+	return id, recipient
+}
+
+// Wrap seals the data key for every recipient with an ephemeral share,
+// the output is "base64(share) base64(sealed key)"
+func (p *ageProvider) Wrap(dataKey []byte) (map[string]string, error) {
+	if len(p.recipients) == 0 {
+		return nil, fmt.Errorf("No age recipient to wrap the data key for")
+	}
+	wrapped := make(map[string]string)
+	for id, recipient := range p.recipients {
+		var ephemeral, share, shared [32]byte
+		if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+			return nil, err
+		}
+		curve25519.ScalarBaseMult(&share, &ephemeral)
+		curve25519.ScalarMult(&shared, &ephemeral, &recipient)
+
+		aead, err := ageWrapCipher(shared, share, recipient)
+		if err != nil {
+			return nil, err
+		}
+		sealed := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), dataKey, nil)
+		wrapped[id] = base64.RawStdEncoding.EncodeToString(share[:]) + " " +
+			base64.RawStdEncoding.EncodeToString(sealed)
+	}
+	return wrapped, nil
+}
+
+// Unwrap opens the data key wrapped for one of the identities
+func (p *ageProvider) Unwrap(wrapped map[string]string) ([]byte, error) {
+	if len(p.identities) == 0 {
+		return nil, fmt.Errorf("No age identity to unwrap the data key with")
+	}
+	for _, identity := range p.identities {
+		id, recipient := ageRecipient(identity)
+		stanza, ok := wrapped[id]
+		if !ok {
+			continue
+		}
+		parts := strings.Split(stanza, " ")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid wrapped key for \"%s\"", id)
+		}
+		shareBytes, err := base64.RawStdEncoding.DecodeString(parts[0])
+		if err != nil || len(shareBytes) != 32 {
+			return nil, fmt.Errorf("Invalid wrapped key for \"%s\"", id)
+		}
+		sealed, err := base64.RawStdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid wrapped key for \"%s\"", id)
+		}
+
+		var share, shared [32]byte
+		copy(share[:], shareBytes)
+		curve25519.ScalarMult(&shared, &identity, &share)
+		// A low order share gives an all zero secret
+		if subtle.ConstantTimeCompare(shared[:], make([]byte, 32)) == 1 {
+			return nil, fmt.Errorf("Invalid wrapped key for \"%s\"", id)
+		}
+		aead, err := ageWrapCipher(shared, share, recipient)
+		if err != nil {
+			return nil, err
+		}
+		dataKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), sealed, nil)
+		if err != nil {
+			return nil, fmt.Errorf("Unwrap the data key for \"%s\" failed: %s", id, err)
+		}
+		return dataKey, nil
+	}
+	return nil, fmt.Errorf("The data key is not wrapped for any of the age identities")
+}
+
+// ageWrapCipher derives the key wrapping cipher of the X25519 stanza of age
+func ageWrapCipher(shared [32]byte, share [32]byte, recipient [32]byte) (cipher.AEAD, error) {
+	salt := append(share[:], recipient[:]...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], salt, []byte(ageX25519Label)), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
@@ -0,0 +1,166 @@
+package kv
+
+import "fmt"
+
+// BatchOp is a change in a batch, a nil Value deletes the key
+type BatchOp struct {
+	Key   string
+	Value *string
+}
+
+// BatchQuerier is implemented by queriers which can apply several changes as a single commit
+type BatchQuerier interface {
+	// Batch applies all ops in one commit and returns a record holding the commit.
+	// Either every op is applied or none is.
+	Batch(ops []*BatchOp) (*KeyRecord, error)
+}
+
+// HeadBatchQuerier is implemented by batch queriers which can write a batch on
+// top of a known commit, for changes computed from what the database held then
+type HeadBatchQuerier interface {
+	BatchQuerier
+	// Head returns the commit the branch points to, empty if it has none
+	Head() (string, error)
+	// BatchOn applies ops like Batch, but only if the branch still points to
+	// head. Otherwise nothing is written and the error matches ErrConflict.
+	BatchOn(ops []*BatchOp, head string) (*KeyRecord, error)
+}
+
+func hasDelete(ops []*BatchOp) bool {
+	for _, op := range ops {
+		if op.Value == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Batch collects changes and writes them as one atomic commit on Exec
+type Batch struct {
+	kv  *KV
+	ops []*BatchOp
+}
+
+// Batch is a function to start a batch
+func (kv *KV) Batch() *Batch {
+	return &Batch{kv: kv}
+}
+
+// Set is a function to add a key update to the batch
+func (b *Batch) Set(key string, value string) *Batch {
+	b.ops = append(b.ops, &BatchOp{Key: key, Value: &value})
+	return b
+}
+
+// Delete is a function to add a key deletion to the batch
+func (b *Batch) Delete(key string) *Batch {
+	b.ops = append(b.ops, &BatchOp{Key: key})
+	return b
+}
+
+// Len is the number of changes in the batch
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Exec is a function to write all changes of the batch in a single commit
+func (b *Batch) Exec() (*KeyRecord, error) {
+	return b.kv.WriteBatch(b.ops)
+}
+
+// WriteBatch is a function to write several changes in a single commit.
+// When a key appears more than once, the last op wins.
+func (kv *KV) WriteBatch(ops []*BatchOp) (*KeyRecord, error) {
+	bq, ok := kv.querier.(BatchQuerier)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support batch writes", kv.querier)
+	}
+	if len(ops) == 0 {
+		return &KeyRecord{}, nil
+	}
+
+	// Keep the last op of every key, in the order they first appeared
+	var keys []string
+	last := make(map[string]*BatchOp)
+	for _, op := range ops {
+		if _, ok := last[op.Key]; !ok {
+			keys = append(keys, op.Key)
+		}
+		last[op.Key] = op
+	}
+	var lockKeys []string
+	for _, key := range keys {
+		lockKeys = append(lockKeys, kv.cacheKey(key))
+	}
+	unlock, err := kv.lock(lockKeys...)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// With encryption, deleting a key removes the copies written in older
+	// formats too, and only the stored names which exist can be deleted
+	var stored map[string]bool
+	if kv.encrypted() && hasDelete(ops) {
+		krl, err := kv.querier.Keys()
+		if err != nil {
+			return nil, err
+		}
+		stored = make(map[string]bool)
+		for _, kr := range *krl {
+			stored[kr.Name] = true
+		}
+	}
+	var encrypted []*BatchOp
+	for _, key := range keys {
+		value := last[key].Value
+		if value == nil {
+			names, err := kv.storedNames(key, false)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				if stored == nil || stored[name] {
+					encrypted = append(encrypted, &BatchOp{Key: name})
+				}
+			}
+			continue
+		}
+		name, err := kv.encryptKey(key)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := kv.encryptValue(name, *value)
+		if err != nil {
+			return nil, err
+		}
+		encrypted = append(encrypted, &BatchOp{Key: name, Value: &sealed})
+	}
+	if len(encrypted) == 0 {
+		return &KeyRecord{}, nil
+	}
+
+	record, err := bq.Batch(encrypted)
+	for _, op := range encrypted {
+		kv.forget(op.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if kv.UseCache {
+		for _, key := range keys {
+			op := last[key]
+			if op.Value == nil {
+				kv.cache.remove(kv.cacheKey(key))
+				continue
+			}
+			kv.cache.set(kv.cacheKey(key), &KeyRecord{
+				Content: *op.Value,
+				Name:    key,
+				Size:    len(*op.Value),
+				Commit:  record.Commit,
+			})
+		}
+	}
+	return record, nil
+}
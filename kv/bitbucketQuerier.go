@@ -0,0 +1,418 @@
+package kv
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// BitbucketQuerier is a querier for bitbucket cloud
+type BitbucketQuerier struct {
+	baseURL   string
+	option    *QuerierOption
+	committer *Committer
+	httpClient
+}
+
+type bitbucketKeyRecord struct {
+	Path   string `json:"path"`
+	Type   string `json:"type"`
+	Size   int    `json:"size"`
+	Commit struct {
+		Hash string `json:"hash"`
+	} `json:"commit"`
+	Links struct {
+		Self struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links"`
+}
+
+type bitbucketPage struct {
+	Values []*bitbucketKeyRecord `json:"values"`
+	Next   string                `json:"next"`
+}
+
+type bitbucketCommit struct {
+	Hash    string    `json:"hash"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message"`
+	Author  struct {
+		// Raw is "name <email>"
+		Raw string `json:"raw"`
+	} `json:"author"`
+}
+
+type bitbucketCommitPage struct {
+	Values []*bitbucketCommit `json:"values"`
+	Next   string             `json:"next"`
+}
+
+// NewBitbucketQuerier is a querier constructor
+func NewBitbucketQuerier(option *QuerierOption) *BitbucketQuerier {
+	if option.APIURL == "" {
+		option.APIURL = "https://api.bitbucket.org/2.0"
+	}
+	return &BitbucketQuerier{
+		baseURL:    bitbucketBaseURL(option.APIURL, option.User, option.Repo),
+		option:     option,
+		committer:  option.Committer,
+		httpClient: httpClient{limits: &rateLimits{}},
+	}
+}
+
+func bitbucketBaseURL(apiURL, user, repo string) string {
+	return fmt.Sprintf("%s/repositories/%s/%s", apiURL, user, repo)
+}
+
+// Keys is a function to list all keys
+func (q *BitbucketQuerier) Keys() (*[]*KeyRecord, error) {
+	record, err := q.listReq()
+	if err != nil {
+		if err.Code == 404 {
+			return nil, newError(ErrNotFound, "Repository not found")
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// Get is a function to read a key
+func (q *BitbucketQuerier) Get(key string) (*KeyRecord, error) {
+	meta, err := q.metaReq(key)
+	if err != nil {
+		if err.Code == 404 {
+			return &KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	body, _, err := q.query(q.srcURL(meta.Commit.Hash, key), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	record := meta.transfer()
+	record.Content = string(*body)
+	return record, nil
+}
+
+// Set is a function to set a key
+func (q *BitbucketQuerier) Set(key string, value string) (*KeyRecord, error) {
+	form := q.commitForm("freedb update a key from golang client")
+	form.Set(q.option.DB+"/"+key, value)
+
+	commit, err := q.commitReq(form)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{
+		Name:   key,
+		Size:   len(value),
+		Commit: commit,
+	}, nil
+}
+
+// Delete is a function to delete a key
+func (q *BitbucketQuerier) Delete(key string) (*KeyRecord, error) {
+	// Deleting a missing file would create an empty commit, check it first
+	_, err := q.metaReq(key)
+	if err != nil {
+		if err.Code == 404 {
+			return &KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	form := q.commitForm("freedb delete a key from golang client")
+	form.Set("files", q.option.DB+"/"+key)
+
+	commit, err := q.commitReq(form)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{
+		Name:   key,
+		Commit: commit,
+	}, nil
+}
+
+// Batch is a function to write several keys in one commit
+func (q *BitbucketQuerier) Batch(ops []*BatchOp) (*KeyRecord, error) {
+	existing := make(map[string]bool)
+	if hasDelete(ops) {
+		krl, err := q.listReq()
+		if err != nil && err.Code != 404 {
+			return nil, err
+		}
+		if krl != nil {
+			for _, kr := range *krl {
+				existing[kr.Name] = true
+			}
+		}
+	}
+
+	form := q.commitForm(fmt.Sprintf("freedb update %d keys from golang client", len(ops)))
+	changed := false
+	for _, op := range ops {
+		if op.Value != nil {
+			form.Set(q.option.DB+"/"+op.Key, *op.Value)
+			changed = true
+		} else if existing[op.Key] {
+			form.Add("files", q.option.DB+"/"+op.Key)
+			changed = true
+		}
+	}
+	if !changed {
+		return &KeyRecord{}, nil
+	}
+	commit, err := q.commitReq(form)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{Commit: commit}, nil
+}
+
+// History is a function to list the commits which touched a key
+func (q *BitbucketQuerier) History(key string) ([]*Revision, error) {
+	params := url.Values{}
+	params.Set("path", strings.TrimSuffix(q.option.DB+"/"+key, "/"))
+	params.Set("pagelen", "100")
+	urlStr := fmt.Sprintf("%s/commits/%s?%s", q.baseURL, url.PathEscape(q.option.Branch), params.Encode())
+
+	history := []*Revision{}
+	for urlStr != "" {
+		body, _, err := q.query(urlStr, "GET", nil)
+		if err != nil {
+			return nil, err
+		}
+		page := &bitbucketCommitPage{}
+		decodeErr := json.Unmarshal(*body, page)
+		if decodeErr != nil {
+			return nil, &httpError{Message: decodeErr.Error()}
+		}
+		for _, commit := range page.Values {
+			history = append(history, commit.transfer())
+		}
+		urlStr = page.Next
+	}
+	return history, nil
+}
+
+// GetAt is a function to read a key at a commit, a tag or a branch
+func (q *BitbucketQuerier) GetAt(key string, ref string) (*KeyRecord, error) {
+	meta, err := q.metaReqAt(key, ref)
+	if err != nil {
+		if err.Code == 404 {
+			return &KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	body, _, err := q.query(q.srcURL(meta.Commit.Hash, key), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	record := meta.transfer()
+	record.Content = string(*body)
+	return record, nil
+}
+
+// KeysAt is a function to list all keys at a commit, a tag or a branch
+func (q *BitbucketQuerier) KeysAt(ref string) (*[]*KeyRecord, error) {
+	record, err := q.listReqAt(ref)
+	if err != nil {
+		if err.Code == 404 {
+			return &[]*KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// SetHost is a function to update the repository
+func (q *BitbucketQuerier) SetHost(user, repo string) {
+	q.baseURL = bitbucketBaseURL(q.option.APIURL, user, repo)
+	q.option.User = user
+	q.option.Repo = repo
+}
+
+// SetAPIURL is a function to update the API base URL
+func (q *BitbucketQuerier) SetAPIURL(apiURL string) {
+	q.baseURL = bitbucketBaseURL(apiURL, q.option.User, q.option.Repo)
+	q.option.APIURL = apiURL
+}
+
+// SetBranch is a function to update the branch
+func (q *BitbucketQuerier) SetBranch(branch string) {
+	q.option.Branch = branch
+}
+
+// Use is a function to change database
+func (q *BitbucketQuerier) Use(db string) {
+	q.option.DB = db
+}
+
+// SetToken is a function to update the token
+func (q *BitbucketQuerier) SetToken(token string) {
+	q.option.Token = token
+}
+
+// Option is a function to get the current option
+func (q *BitbucketQuerier) Option() *QuerierOption {
+	return q.option
+}
+
+// RateLimit is a function to get the rate limit reported by the last response
+func (q *BitbucketQuerier) RateLimit() (*RateLimit, error) {
+	return q.rateLimit(func() *httpError {
+		_, _, err := q.query(q.baseURL, "GET", nil)
+		return err
+	})
+}
+
+// WithContext is a function to get a copy of the querier whose requests are cancelled when ctx is done
+func (q *BitbucketQuerier) WithContext(ctx context.Context) Querier {
+	c := *q
+	c.ctx = ctx
+	return &c
+}
+
+func (q *BitbucketQuerier) srcURL(ref string, key string) string {
+	urlStr := fmt.Sprintf("%s/src/%s/%s", q.baseURL, url.PathEscape(ref), q.option.DB)
+	if key != "" {
+		urlStr += "/" + key
+	}
+	return urlStr
+}
+
+func (q *BitbucketQuerier) commitForm(message string) url.Values {
+	form := url.Values{}
+	form.Set("message", message)
+	form.Set("branch", q.option.Branch)
+	if q.committer != nil {
+		form.Set("author", fmt.Sprintf("%s <%s>", q.committer.Name, q.committer.Email))
+	}
+	return form
+}
+
+func (q *BitbucketQuerier) listReq() (*[]*KeyRecord, *httpError) {
+	return q.listReqAt(q.option.Branch)
+}
+
+// listReqAt lists the keys at a ref, which can be a branch, a tag or a commit
+func (q *BitbucketQuerier) listReqAt(ref string) (*[]*KeyRecord, *httpError) {
+	urlStr := q.srcURL(ref, "") + "/?pagelen=100"
+	var krl []*KeyRecord
+	for urlStr != "" {
+		body, _, err := q.query(urlStr, "GET", nil)
+		if err != nil {
+			return nil, err
+		}
+		page := &bitbucketPage{}
+		decodeErr := json.Unmarshal(*body, page)
+		if decodeErr != nil {
+			return nil, &httpError{Message: decodeErr.Error()}
+		}
+		for _, bkr := range page.Values {
+			if bkr.Type != "commit_file" {
+				continue
+			}
+			krl = append(krl, bkr.transfer())
+		}
+		urlStr = page.Next
+	}
+	return &krl, nil
+}
+
+func (q *BitbucketQuerier) metaReq(key string) (*bitbucketKeyRecord, *httpError) {
+	return q.metaReqAt(key, q.option.Branch)
+}
+
+// metaReqAt reads the meta data of a key at a ref, which can be a branch, a tag or a commit
+func (q *BitbucketQuerier) metaReqAt(key string, ref string) (*bitbucketKeyRecord, *httpError) {
+	body, _, err := q.query(q.srcURL(ref, key)+"?format=meta", "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	bkr := &bitbucketKeyRecord{}
+	decodeErr := json.Unmarshal(*body, bkr)
+	if decodeErr != nil {
+		return nil, &httpError{Message: decodeErr.Error()}
+	}
+	if bkr.Type == "commit_directory" {
+		return nil, &httpError{Message: fmt.Sprintf("'%s' is a folder", key), err: ErrIsFolder}
+	}
+	return bkr, nil
+}
+
+// commitReq posts to the src endpoint and returns the hash of the new commit
+func (q *BitbucketQuerier) commitReq(form url.Values) (string, *httpError) {
+	_, header, err := q.query(q.baseURL+"/src", "POST", form)
+	if err != nil {
+		return "", err
+	}
+	location := header.Get("Location")
+	return location[strings.LastIndex(location, "/")+1:], nil
+}
+
+func (q *BitbucketQuerier) query(urlStr string, method string, form url.Values) (*[]byte, http.Header, *httpError) {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := q.newRequest(method, urlStr, body, "application/x-www-form-urlencoded")
+	if err != nil {
+		return nil, nil, err
+	}
+	// "username:app_password" is sent as basic auth, others are access tokens
+	if i := strings.Index(q.option.Token, ":"); i > -1 {
+		req.SetBasicAuth(q.option.Token[:i], q.option.Token[i+1:])
+	} else if q.option.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+q.option.Token)
+	}
+
+	resp, err := q.send(q.option, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 299 {
+		var errBody struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.Unmarshal(respBody, &errBody)
+		return nil, nil, statusError(resp, errBody.Error.Message)
+	}
+	return &respBody, resp.Header, nil
+}
+
+func (bkr *bitbucketKeyRecord) transfer() *KeyRecord {
+	return &KeyRecord{
+		Name:   bkr.Path[strings.LastIndex(bkr.Path, "/")+1:],
+		Size:   bkr.Size,
+		RawURL: bkr.Links.Self.Href,
+		Commit: bkr.Commit.Hash,
+		Path:   bkr.Path,
+	}
+}
+
+func (bc *bitbucketCommit) transfer() *Revision {
+	revision := &Revision{
+		Commit:  bc.Hash,
+		Author:  bc.Author.Raw,
+		Date:    bc.Date,
+		Message: bc.Message,
+	}
+	if address, err := mail.ParseAddress(bc.Author.Raw); err == nil {
+		revision.Author = address.Name
+		revision.Email = address.Address
+	}
+	return revision
+}
@@ -0,0 +1,94 @@
+package kv
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newBitbucketTestServer fakes the part of the bitbucket src API used by BitbucketQuerier
+func newBitbucketTestServer(t *testing.T) *httptest.Server {
+	files := make(map[string]string)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.Method == "POST" {
+			r.ParseForm()
+			if r.PostForm.Get("branch") != "master" {
+				t.Errorf("expect branch master, got %s", r.PostForm.Get("branch"))
+			}
+			for name, values := range r.PostForm {
+				if strings.HasPrefix(name, "golang/") {
+					files[name] = values[0]
+				}
+			}
+			delete(files, r.PostForm.Get("files"))
+			w.Header().Set("Location", "https://api.bitbucket.org/2.0/repositories/u/r/commit/abcdef")
+			w.WriteHeader(201)
+			return
+		}
+		// /repositories/{user}/{repo}/src/{ref}/{path}
+		path := strings.SplitN(r.URL.Path[strings.Index(r.URL.Path, "/src/")+5:], "/", 2)[1]
+		if path == "golang/" {
+			page := &bitbucketPage{}
+			for name := range files {
+				page.Values = append(page.Values, &bitbucketKeyRecord{Path: name, Type: "commit_file"})
+			}
+			json.NewEncoder(w).Encode(page)
+			return
+		}
+		content, ok := files[path]
+		if !ok {
+			w.WriteHeader(404)
+			return
+		}
+		if r.URL.Query().Get("format") == "meta" {
+			bkr := &bitbucketKeyRecord{Path: path, Type: "commit_file", Size: len(content)}
+			bkr.Commit.Hash = "abcdef"
+			json.NewEncoder(w).Encode(bkr)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+}
+
+func TestBitbucketQuerier(t *testing.T) {
+	server := newBitbucketTestServer(t)
+	defer server.Close()
+
+	kv, err := NewKV("git@bitbucket.org:Gcaufy-Test/test-database.git", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.UseCache = false
+	kv.Use("golang")
+	kv.SetAPIURL(server.URL)
+
+	record, err := kv.Set("key-exist", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Commit != "abcdef" {
+		t.Errorf("expect commit abcdef, got %s", record.Commit)
+	}
+	if record, _ = kv.Append("key-exist", "456"); record.Content != "123456" {
+		t.Errorf("expect 123456, got %s", record.Content)
+	}
+	list, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*list) != 1 || (*list)[0].Name != "key-exist" {
+		t.Errorf("unexpected keys %v", *list)
+	}
+	if record, _ = kv.Delete("key-exist"); record.Name != "key-exist" {
+		t.Error("expect key-exist to be deleted")
+	}
+	if record, _ = kv.Delete("key-exist"); record.Name != "" {
+		t.Error("expect key-exist to be missing")
+	}
+}
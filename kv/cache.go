@@ -0,0 +1,166 @@
+package kv
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCacheSize is the number of keys a KV caches by default
+	DefaultCacheSize = 1024
+	// DefaultCacheTTL is how long a cached key is trusted by default, 0 is forever
+	DefaultCacheTTL time.Duration = 0
+)
+
+// CacheMode tells KV.Get when to trust its cache
+type CacheMode int
+
+const (
+	// CacheAlways serves cached keys until they expire or are evicted
+	CacheAlways CacheMode = iota
+	// CacheRevalidate asks the querier on every read. The github and gitea
+	// queriers revalidate with conditional requests, which are cheap and do
+	// not count against the rate limit when the key did not change.
+	CacheRevalidate
+	// CacheNever caches nothing
+	CacheNever
+)
+
+// recordCache is a LRU cache of key records, safe for concurrent use
+type recordCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	// order has the most recently used entry first
+	order *list.List
+	now   func() time.Time
+}
+
+type cacheEntry struct {
+	key     string
+	record  KeyRecord
+	expires time.Time
+}
+
+func newRecordCache(size int, ttl time.Duration) *recordCache {
+	return &recordCache{
+		size:  size,
+		ttl:   ttl,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+		now:   time.Now,
+	}
+}
+
+// get returns a copy of the cached record, expired records are dropped
+func (c *recordCache) get(key string) (*KeyRecord, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && !c.now().Before(entry.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	record := entry.record
+	return &record, true
+}
+
+// set caches a copy of record, evicting the least recently used ones over size
+func (c *recordCache) set(key string, record *KeyRecord) {
+	if record == nil {
+		c.remove(key)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	entry := &cacheEntry{key: key, record: *record}
+	if c.ttl > 0 {
+		entry.expires = c.now().Add(c.ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *recordCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *recordCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// resize changes the bounds, the entries over size are evicted
+func (c *recordCache) resize(size int, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.ttl = ttl
+	for c.order.Len() > 0 && c.order.Len() > c.size {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *recordCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *recordCache) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+}
+
+// cacheKey namespaces a key by the database it belongs to
+func (kv *KV) cacheKey(key string) string {
+	return kv.location() + "/" + key
+}
+
+// SetCacheMode is a function to choose when the cache is trusted,
+// UseCache is false with CacheNever only
+func (kv *KV) SetCacheMode(mode CacheMode) {
+	kv.cacheMode = mode
+	kv.UseCache = mode != CacheNever
+	if !kv.UseCache {
+		kv.ClearCache()
+	}
+}
+
+// cacheHit returns the cached record of key when the cache mode trusts it
+func (kv *KV) cacheHit(key string) (*KeyRecord, bool) {
+	if !kv.UseCache || kv.cacheMode == CacheRevalidate {
+		return nil, false
+	}
+	return kv.cache.get(kv.cacheKey(key))
+}
+
+// SetCacheLimit is a function to bound the cache of the KV to size keys, each
+// trusted for ttl. A ttl of 0 trusts cached keys until they are evicted, and a
+// size of 0 caches nothing.
+func (kv *KV) SetCacheLimit(size int, ttl time.Duration) {
+	kv.cache.resize(size, ttl)
+}
@@ -0,0 +1,186 @@
+package kv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheLRU(t *testing.T) {
+	now := time.Now()
+	c := newRecordCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.set("a", &KeyRecord{Content: "1"})
+	c.set("b", &KeyRecord{Content: "2"})
+	c.get("a")
+	c.set("c", &KeyRecord{Content: "3"})
+	if _, ok := c.get("b"); ok {
+		t.Error("expect b to be evicted")
+	}
+	if record, ok := c.get("a"); !ok || record.Content != "1" {
+		t.Errorf("expect a to be cached, got %v", record)
+	}
+	// Cached records can not be changed through the returned copy
+	record, _ := c.get("a")
+	record.Content = "changed"
+	if record, _ := c.get("a"); record.Content != "1" {
+		t.Errorf("expect 1, got %s", record.Content)
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error("expect a to be expired")
+	}
+	c.resize(0, 0)
+	c.set("d", &KeyRecord{Content: "4"})
+	if c.len() != 0 {
+		t.Errorf("expect an empty cache, got %d", c.len())
+	}
+}
+
+func TestMemoryCacheUse(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.Use("first")
+	kv.Set("name", "first")
+	kv.Use("second")
+	if record, _ := kv.Get("name"); record.Content != "" {
+		t.Errorf("expect no value in the second db, got %s", record.Content)
+	}
+	kv.Set("name", "second")
+	kv.Use("first")
+	if record, _ := kv.Get("name"); record.Content != "first" {
+		t.Errorf("expect first, got %s", record.Content)
+	}
+
+	// Another instance does not share the cache
+	other := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	if record, _ := other.Get("name"); record.Content != "" {
+		t.Errorf("expect no value, got %s", record.Content)
+	}
+}
+
+func TestMemoryCacheConcurrent(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.SetCacheLimit(8, time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := fmt.Sprintf("key%d", (i+j)%16)
+				kv.cache.set(kv.cacheKey(key), &KeyRecord{Name: key})
+				kv.cache.get(kv.cacheKey(key))
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := kv.cache.len(); n > 8 {
+		t.Errorf("expect at most 8 keys, got %d", n)
+	}
+}
+
+// offlineQuerier fails while offline is set, as without network
+type offlineQuerier struct {
+	*MemoryQuerier
+	offline bool
+	// fail is returned by Get instead of querying, e.g. a host error
+	fail error
+	gets int
+}
+
+type unreachable struct{}
+
+func (e *unreachable) Error() string     { return "network is unreachable" }
+func (e *unreachable) Unreachable() bool { return true }
+
+func (q *offlineQuerier) Get(key string) (*KeyRecord, error) {
+	if q.offline {
+		return nil, &unreachable{}
+	}
+	if q.fail != nil {
+		return nil, q.fail
+	}
+	q.gets++
+	return q.MemoryQuerier.Get(key)
+}
+
+func (q *offlineQuerier) Set(key string, value string) (*KeyRecord, error) {
+	if q.offline {
+		return nil, &unreachable{}
+	}
+	return q.MemoryQuerier.Set(key, value)
+}
+
+func (q *offlineQuerier) Delete(key string) (*KeyRecord, error) {
+	if q.offline {
+		return nil, &unreachable{}
+	}
+	return q.MemoryQuerier.Delete(key)
+}
+
+func TestMemoryDiskCache(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "freedb")
+	defer os.RemoveAll(dir)
+	querier := &offlineQuerier{MemoryQuerier: NewMemoryQuerier(nil, nil)}
+	kv := NewKVWithQuerier(querier)
+	kv.SetCacheMode(CacheNever)
+	kv.SetSecret("secret")
+	if err := kv.SetDiskCache(dir, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	kv.Set("name", "value")
+	newRun := func() *KV {
+		run := NewKVWithQuerier(querier)
+		run.SetCacheMode(CacheNever)
+		run.SetSecret("secret")
+		run.SetDiskCache(dir, time.Hour)
+		return run
+	}
+	newRun().Get("name")
+
+	// Another run reads the disk without querying
+	other := newRun()
+	gets := querier.gets
+	if record, err := other.Get("name"); err != nil || record.Content != "value" {
+		t.Fatalf("expect value, got %v %v", record, err)
+	}
+	if querier.gets != gets {
+		t.Errorf("expect no query, got %d", querier.gets-gets)
+	}
+	// Values are kept encrypted
+	files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+	for _, file := range files {
+		if content, _ := ioutil.ReadFile(file); strings.Contains(string(content), "value") {
+			t.Errorf("expect %s to be encrypted, got %s", file, content)
+		}
+	}
+
+	// Writing drops the cached copy
+	other.Set("name", "changed")
+	if record, _ := kv.Get("name"); record.Content != "changed" {
+		t.Errorf("expect changed, got %s", record.Content)
+	}
+
+	// Expired records are only read offline
+	other.SetDiskCache(dir, 0)
+	querier.offline = true
+	if _, err := other.Get("name"); err == nil {
+		t.Error("expect the query to fail")
+	}
+	other.SetOffline(true)
+	if record, err := other.Get("name"); err != nil || record.Content != "changed" {
+		t.Errorf("expect changed, got %v %v", record, err)
+	}
+	// An error of the host is not served from the disk
+	querier.offline = false
+	querier.fail = &memoryError{Code: 401, Message: "Invalid token"}
+	if _, err := other.Get("name"); err != querier.fail {
+		t.Errorf("expect the 401 error, got %v", err)
+	}
+}
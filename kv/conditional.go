@@ -0,0 +1,76 @@
+package kv
+
+import "fmt"
+
+// ConflictError is returned by a conditional write when the key does not match the expectation
+type ConflictError struct {
+	Key string
+	// Expected is the sha or commit the key was expected to match, empty means the key was expected to be missing
+	Expected string
+}
+
+func (e *ConflictError) Error() string {
+	if e.Expected == "" {
+		return fmt.Sprintf("Key \"%s\" already exists", e.Key)
+	}
+	return fmt.Sprintf("Key \"%s\" has been changed since %s", e.Key, e.Expected)
+}
+
+// Is reports whether target is ErrConflict
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+// ConditionalQuerier is implemented by queriers which support compare-and-swap writes
+type ConditionalQuerier interface {
+	// SetIfMatch writes the key only if it still matches expected, which is
+	// either the sha of the key, or a commit since which the key has not changed.
+	// An empty expected means the key must not exist. A mismatch returns a
+	// *ConflictError and is never retried.
+	SetIfMatch(key string, value string, expected string) (*KeyRecord, error)
+}
+
+// SetIfMatch is the function to update a key only if it has not changed since it was read.
+// expected is the Sha of the KeyRecord that was read, or a commit since which the
+// key should be unchanged. It returns a *ConflictError if someone else changed the key.
+func (kv *KV) SetIfMatch(key string, value string, expected string) (*KeyRecord, error) {
+	cq, ok := kv.querier.(ConditionalQuerier)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support conditional writes", kv.querier)
+	}
+	unlock, err := kv.lock(kv.cacheKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	name, err := kv.encryptKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := kv.encryptValue(name, value)
+	if err != nil {
+		return nil, err
+	}
+	record, err := cq.SetIfMatch(name, encrypted, expected)
+	kv.forget(name)
+	if err != nil {
+		if _, ok := err.(*ConflictError); ok {
+			if kv.UseCache {
+				kv.cache.remove(kv.cacheKey(key))
+			}
+			return nil, &ConflictError{Key: key, Expected: expected}
+		}
+		return nil, err
+	}
+	record.Content = value
+	if kv.UseCache {
+		kv.cache.set(kv.cacheKey(key), record)
+	}
+	return record, nil
+}
+
+// SetIfNotExists is the function to create a key only if it does not exist yet,
+// it returns a *ConflictError if the key exists.
+func (kv *KV) SetIfNotExists(key string, value string) (*KeyRecord, error) {
+	return kv.SetIfMatch(key, value, "")
+}
@@ -0,0 +1,116 @@
+package kv
+
+import "context"
+
+// ContextQuerier is implemented by queriers whose queries can be cancelled.
+// The queries of a querier which does not implement it, e.g. one added with
+// RegisterQuerier, run to their end: the Context functions of KV then only
+// stop before the first query and while waiting for the lock of a key.
+type ContextQuerier interface {
+	// WithContext returns a copy of the querier whose queries are cancelled
+	// when ctx is done. The copy shares the option and the state of the querier.
+	WithContext(ctx context.Context) Querier
+}
+
+// canceled reports whether a query failed because its context is done
+func canceled(ctx context.Context) bool {
+	return ctx != nil && ctx.Err() != nil
+}
+
+// withContext returns a copy of the KV whose queries are bound to ctx, the
+// copy shares the caches, the journal and the locks of the KV
+func (kv *KV) withContext(ctx context.Context) *KV {
+	c := *kv
+	c.ctx = ctx
+	if cq, ok := kv.querier.(ContextQuerier); ok {
+		c.querier = cq.WithContext(ctx)
+	}
+	return &c
+}
+
+// lock waits for the locks of keys, a copy made by withContext gives up
+// once its context is done
+func (kv *KV) lock(keys ...string) (func(), error) {
+	return kv.locks.lockContext(kv.ctx, keys...)
+}
+
+// contextErr returns the error of ctx instead of err when ctx is done, so
+// that callers can compare it with context.Canceled or context.DeadlineExceeded
+func contextErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// GetContext is the function to get a key, it is cancelled when ctx is done
+func (kv *KV) GetContext(ctx context.Context, key string) (*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	record, err := kv.withContext(ctx).Get(key)
+	return record, contextErr(ctx, err)
+}
+
+// SetContext is the function to update or create a key, it is cancelled when
+// ctx is done. A cancelled write is never journaled.
+func (kv *KV) SetContext(ctx context.Context, key string, value string) (*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	record, err := kv.withContext(ctx).Set(key, value)
+	return record, contextErr(ctx, err)
+}
+
+// AppendContext is the function to append value to a key, it is cancelled when ctx is done
+func (kv *KV) AppendContext(ctx context.Context, key string, value string) (*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	record, err := kv.withContext(ctx).Append(key, value)
+	return record, contextErr(ctx, err)
+}
+
+// DeleteContext is the function to delete a key, it is cancelled when ctx is done
+func (kv *KV) DeleteContext(ctx context.Context, key string) (*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	record, err := kv.withContext(ctx).Delete(key)
+	return record, contextErr(ctx, err)
+}
+
+// KeysContext is the function to list all keys, it is cancelled when ctx is done
+func (kv *KV) KeysContext(ctx context.Context) (*[]*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	krl, err := kv.withContext(ctx).Keys()
+	return krl, contextErr(ctx, err)
+}
+
+// SetIfMatchContext is the function to update a key only if it has not
+// changed since it was read, it is cancelled when ctx is done
+func (kv *KV) SetIfMatchContext(ctx context.Context, key string, value string, expected string) (*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	record, err := kv.withContext(ctx).SetIfMatch(key, value, expected)
+	return record, contextErr(ctx, err)
+}
+
+// WriteBatchContext is the function to write several changes in a single
+// commit, it is cancelled when ctx is done
+func (kv *KV) WriteBatchContext(ctx context.Context, ops []*BatchOp) (*KeyRecord, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	record, err := kv.withContext(ctx).WriteBatch(ops)
+	return record, contextErr(ctx, err)
+}
+
+// ExecContext is a function to write all changes of the batch in a single
+// commit, it is cancelled when ctx is done
+func (b *Batch) ExecContext(ctx context.Context) (*KeyRecord, error) {
+	return b.kv.WriteBatchContext(ctx, b.ops)
+}
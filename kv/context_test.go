@@ -0,0 +1,108 @@
+package kv
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMemoryContext(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.SetSecret("secret")
+	ctx, cancel := context.WithCancel(context.Background())
+	if _, err := kv.SetContext(ctx, "key", "1"); err != nil {
+		t.Fatal(err)
+	}
+	kv.ClearCache()
+	if record, err := kv.GetContext(ctx, "key"); err != nil || record.Content != "1" {
+		t.Fatalf("expect 1, got %v %v", record, err)
+	}
+
+	cancel()
+	if _, err := kv.SetContext(ctx, "key", "2"); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+	if _, err := kv.KeysContext(ctx); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+	// The querier of the KV is not bound to the context
+	if record, err := kv.Get("key"); err != nil || record.Content != "1" {
+		t.Errorf("expect 1, got %v %v", record, err)
+	}
+	querier := NewMemoryQuerier(nil, nil).WithContext(ctx)
+	if _, err := querier.Set("key", "1"); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+}
+
+func TestMemoryContextLockWait(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	// A write of the key is in progress
+	unlock := kv.locks.lock(kv.cacheKey("key"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := kv.GetContext(ctx, "key"); err != context.DeadlineExceeded {
+		t.Errorf("expect context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := kv.SetContext(ctx, "key", "1"); err != context.DeadlineExceeded {
+		t.Errorf("expect context.DeadlineExceeded, got %v", err)
+	}
+	unlock()
+	if len(kv.locks.locks) != 0 {
+		t.Errorf("expect the locks to be dropped, got %d", len(kv.locks.locks))
+	}
+	if _, err := kv.SetContext(context.Background(), "key", "1"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGithubContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(404)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	dir, _ := ioutil.TempDir("", "freedb")
+	defer os.RemoveAll(dir)
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(server.URL)
+	if err := kv.SetJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := kv.GetContext(ctx, "key"); err != context.DeadlineExceeded {
+		t.Errorf("expect context.DeadlineExceeded, got %v", err)
+	}
+	if _, err := kv.SetContext(ctx, "key", "1"); err != context.DeadlineExceeded {
+		t.Errorf("expect context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expect the requests to be cancelled, took %v", elapsed)
+	}
+
+	// A cancelled write is not journaled
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := kv.SetContext(ctx, "key", "1"); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+	if record, _, ok := kv.pendingRecord("key"); ok {
+		t.Errorf("expect no journaled write, got %v", record)
+	}
+}
@@ -0,0 +1,170 @@
+package kv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCache keeps the stored records read by KV.Get on disk, one folder per
+// database and one file per stored name. Names and values are kept as stored,
+// so they stay encrypted when a secret or key providers are set.
+type diskCache struct {
+	dir string
+	ttl time.Duration
+	now func() time.Time
+}
+
+type diskEntry struct {
+	Record *KeyRecord `json:"record"`
+	Time   time.Time  `json:"time"`
+}
+
+// DefaultDiskCacheDir returns the folder of the disk cache in the user cache dir
+func DefaultDiskCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "freedb"), nil
+}
+
+func hashName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// folder returns where the records of a database are kept
+func (c *diskCache) folder(location string) string {
+	return filepath.Join(c.dir, hashName(location))
+}
+
+func (c *diskCache) file(location string, name string) string {
+	return filepath.Join(c.folder(location), hashName(name))
+}
+
+// get returns the record of a stored name and whether it is younger than the
+// ttl. A missing key is cached as an empty record.
+func (c *diskCache) get(location string, name string) (*KeyRecord, bool, bool) {
+	content, err := ioutil.ReadFile(c.file(location, name))
+	if err != nil {
+		return nil, false, false
+	}
+	entry := &diskEntry{}
+	if err := json.Unmarshal(content, entry); err != nil || entry.Record == nil {
+		return nil, false, false
+	}
+	fresh := c.ttl > 0 && c.now().Sub(entry.Time) < c.ttl
+	return entry.Record, fresh, true
+}
+
+// set writes the record of a stored name, the cache is best effort and
+// failures are ignored
+func (c *diskCache) set(location string, name string, record *KeyRecord) {
+	if err := os.MkdirAll(c.folder(location), 0700); err != nil {
+		return
+	}
+	content, _ := json.Marshal(&diskEntry{Record: record, Time: c.now()})
+	// Another writer may write the same name, each one renames its own file
+	tmp, err := ioutil.TempFile(c.folder(location), "tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(content)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	os.Rename(tmp.Name(), c.file(location, name))
+}
+
+func (c *diskCache) remove(location string, name string) {
+	os.Remove(c.file(location, name))
+}
+
+// clear removes the records of a database
+func (c *diskCache) clear(location string) {
+	os.RemoveAll(c.folder(location))
+}
+
+// SetDiskCache is a function to keep the records read by Get on disk, in dir
+// or in DefaultDiskCacheDir if dir is empty. A record younger than ttl is read
+// from disk without querying, a ttl of 0 always queries. Records are kept as
+// stored, so they are encrypted if a secret is set.
+func (kv *KV) SetDiskCache(dir string, ttl time.Duration) error {
+	if dir == "" {
+		var err error
+		if dir, err = DefaultDiskCacheDir(); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	kv.disk = &diskCache{dir: dir, ttl: ttl, now: time.Now}
+	return nil
+}
+
+// DisableDiskCache is a function to stop using the disk cache, the files are kept
+func (kv *KV) DisableDiskCache() {
+	kv.disk = nil
+}
+
+// SetOffline is a function to let Get serve the disk cache, however old, when
+// the host can not be reached, e.g. without network
+func (kv *KV) SetOffline(offline bool) {
+	kv.offline = offline
+}
+
+// fetch reads a stored name through the journal and the disk cache
+func (kv *KV) fetch(name string) (*KeyRecord, error) {
+	record, appended, ok := kv.pendingRecord(name)
+	if !ok || record == nil {
+		var err error
+		if record, err = kv.fetchStored(name); err != nil {
+			return nil, err
+		}
+	}
+	if len(appended) == 0 {
+		return record, nil
+	}
+	return kv.appendPending(name, record, appended)
+}
+
+// fetchStored reads a stored name from the disk cache or the host
+func (kv *KV) fetchStored(name string) (*KeyRecord, error) {
+	if kv.disk == nil {
+		return kv.querier.Get(name)
+	}
+	loc := kv.location()
+	cached, fresh, ok := kv.disk.get(loc, name)
+	if ok && fresh {
+		return cached, nil
+	}
+	record, err := kv.querier.Get(name)
+	if err != nil {
+		// Only a host which can not be reached falls back, not e.g. a revoked token
+		if ok && kv.offline && isUnreachable(err) {
+			return cached, nil
+		}
+		return nil, err
+	}
+	kv.disk.set(loc, name, record)
+	return record, nil
+}
+
+// forget drops stored names from the disk cache after they are written
+func (kv *KV) forget(names ...string) {
+	if kv.disk == nil {
+		return
+	}
+	loc := kv.location()
+	for _, name := range names {
+		kv.disk.remove(loc, name)
+	}
+}
@@ -0,0 +1,63 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The errors of KV and of the queriers match these with errors.Is, e.g.
+// errors.Is(err, ErrNotFound), whatever the backend
+var (
+	// ErrNotFound is a missing repository, revision, or key with KV.SetStrict
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized is a token which is invalid or has no access to the repository
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrConflict is a key which changed since it was read
+	ErrConflict = errors.New("conflict")
+	// ErrRateLimited is a request rejected by the rate limit of the host
+	ErrRateLimited = errors.New("rate limited")
+	// ErrIsFolder is a key which is a folder in the repository
+	ErrIsFolder = errors.New("is a folder")
+)
+
+// StatusError is implemented by the errors of the http queriers, get the
+// http status of the response with errors.As
+type StatusError interface {
+	error
+	// StatusCode is the http status of the response, 0 if there was none
+	StatusCode() int
+}
+
+// statusIs reports whether an http status matches a sentinel error
+func statusIs(code int, target error) bool {
+	switch target {
+	case ErrNotFound:
+		return code == 404
+	case ErrUnauthorized:
+		return code == 401 || code == 403
+	case ErrConflict:
+		return code == 409
+	case ErrRateLimited:
+		return code == 429
+	}
+	return false
+}
+
+// wrapError is an error with its own message which matches a sentinel error
+type wrapError struct {
+	msg string
+	err error
+}
+
+func (e *wrapError) Error() string {
+	return e.msg
+}
+
+func (e *wrapError) Unwrap() error {
+	return e.err
+}
+
+// newError returns an error with a formatted message which matches err
+func newError(err error, format string, args ...interface{}) error {
+	return &wrapError{msg: fmt.Sprintf(format, args...), err: err}
+}
@@ -0,0 +1,104 @@
+package kv
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMemoryErrors(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	if record, err := kv.Get("missing"); err != nil || record.Name != "" {
+		t.Errorf("expect an empty record, got %v %v", record, err)
+	}
+	kv.SetStrict(true)
+	if _, err := kv.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expect ErrNotFound, got %v", err)
+	}
+	// Append still creates a missing key
+	if record, err := kv.Append("missing", "1"); err != nil || record.Content != "1" {
+		t.Errorf("expect 1, got %v %v", record, err)
+	}
+
+	_, err := kv.SetIfMatch("missing", "2", "stale")
+	var conflict *ConflictError
+	if !errors.Is(err, ErrConflict) || !errors.As(err, &conflict) || conflict.Key != "missing" {
+		t.Errorf("expect a *ConflictError matching ErrConflict, got %v", err)
+	}
+
+	_, err = kv.GetAt("missing", "unknown")
+	var status StatusError
+	if !errors.Is(err, ErrNotFound) || !errors.As(err, &status) || status.StatusCode() != 404 {
+		t.Errorf("expect a 404 matching ErrNotFound, got %v", err)
+	}
+}
+
+func TestGithubErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/Gcaufy-Test/test-database/contents/default/unauthorized":
+			w.WriteHeader(401)
+		case "/repos/Gcaufy-Test/test-database/contents/default/limited":
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(403)
+		case "/repos/Gcaufy-Test/test-database/contents/default/folder":
+			w.Write([]byte(`[{"name": "key"}]`))
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(server.URL)
+	kv.SetRetryPolicy(&RetryPolicy{})
+
+	tests := []struct {
+		key    string
+		match  error
+		differ error
+	}{
+		{"unauthorized", ErrUnauthorized, ErrNotFound},
+		{"limited", ErrRateLimited, ErrUnauthorized},
+		{"folder", ErrIsFolder, ErrNotFound},
+	}
+	for _, test := range tests {
+		_, err := kv.Get(test.key)
+		if !errors.Is(err, test.match) || errors.Is(err, test.differ) {
+			t.Errorf("%s: expect %v and not %v, got %v", test.key, test.match, test.differ, err)
+		}
+	}
+	if _, err := kv.Keys(); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expect ErrNotFound, got %v", err)
+	}
+}
+
+func TestStatusError(t *testing.T) {
+	tests := []struct {
+		code    int
+		header  string
+		message string
+		expect  string
+		match   error
+	}{
+		{401, "", "Bad credentials", "[401] Invalid token", ErrUnauthorized},
+		{404, "", "", "[404] Invalid repository or invalid key", ErrNotFound},
+		{429, "", "Slow down", "[429] Slow down", ErrRateLimited},
+		{403, "0", "", "[403] 403 Forbidden", ErrRateLimited},
+		{409, "", "", "[409] 409 Conflict", ErrConflict},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.code, Status: fmt.Sprintf("%d %s", test.code, http.StatusText(test.code)), Header: http.Header{}}
+		if test.header != "" {
+			resp.Header.Set("X-RateLimit-Remaining", test.header)
+		}
+		err := statusError(resp, test.message)
+		if err.Error() != test.expect || !errors.Is(err, test.match) || err.StatusCode() != test.code {
+			t.Errorf("expect %s matching %v, got %v", test.expect, test.match, err)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package kv
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// GiteaQuerier is a querier for self-hosted gitea or forgejo.
+// Their contents API is close to github's, so it reuses GithubQuerier with a
+// different API base URL. The only difference is that new files are created with POST.
+type GiteaQuerier struct {
+	*GithubQuerier
+}
+
+type giteaChangeFile struct {
+	Operation string `json:"operation"`
+	Path      string `json:"path"`
+	Content   string `json:"content,omitempty"`
+	Sha       string `json:"sha,omitempty"`
+}
+
+type giteaBranch struct {
+	Commit struct {
+		ID string `json:"id"`
+	} `json:"commit"`
+}
+
+type giteaChangeFilesOption struct {
+	Branch    string             `json:"branch"`
+	Message   string             `json:"message"`
+	Author    *Committer         `json:"author,omitempty"`
+	Committer *Committer         `json:"committer,omitempty"`
+	Files     []*giteaChangeFile `json:"files"`
+}
+
+// NewGiteaQuerier is a querier constructor, the API base URL defaults to https://<host>/api/v1
+func NewGiteaQuerier(option *QuerierOption) *GiteaQuerier {
+	if option.APIURL == "" {
+		option.APIURL = "https://" + option.Host + "/api/v1"
+	}
+	q := NewGithubQuerier(option)
+	q.createMethod = "POST"
+	return &GiteaQuerier{q}
+}
+
+// WithContext is a function to get a copy of the querier whose requests are cancelled when ctx is done
+func (q *GiteaQuerier) WithContext(ctx context.Context) Querier {
+	c := *q.GithubQuerier
+	c.ctx = ctx
+	return &GiteaQuerier{&c}
+}
+
+// Head is a function to get the commit the branch points to
+func (q *GiteaQuerier) Head() (string, error) {
+	branch := &giteaBranch{}
+	repoURL := githubRepoURL(q.option.APIURL, q.option.User, q.option.Repo)
+	if err := q.requestJSON(repoURL+"/branches/"+q.option.Branch, "GET", nil, branch); err != nil {
+		if err.Code == 404 {
+			return "", nil
+		}
+		return "", err
+	}
+	return branch.Commit.ID, nil
+}
+
+// BatchOn is a function to write several keys in one commit if the branch
+// still points to head. The change files API can not pin the parent, so the
+// head is checked right before the commit, and a key changed in between fails
+// the commit with its stale sha.
+func (q *GiteaQuerier) BatchOn(ops []*BatchOp, head string) (*KeyRecord, error) {
+	current, err := q.Head()
+	if err != nil {
+		return nil, err
+	}
+	if current != head {
+		return nil, q.movedError(head)
+	}
+	return q.Batch(ops)
+}
+
+// Batch is a function to write several keys in one commit.
+// Gitea has no git data API, it uses the change files API instead.
+func (q *GiteaQuerier) Batch(ops []*BatchOp) (*KeyRecord, error) {
+	// Updates and deletions need the current sha, listing refreshes them
+	existing := make(map[string]bool)
+	krl, err := q.listReq()
+	if err != nil && err.Code != 404 {
+		return nil, err
+	}
+	if krl != nil {
+		for _, kr := range *krl {
+			existing[kr.Name] = true
+		}
+	}
+
+	gcfo := &giteaChangeFilesOption{
+		Branch:    q.option.Branch,
+		Message:   fmt.Sprintf("freedb update %d keys from golang client", len(ops)),
+		Author:    q.committer,
+		Committer: q.committer,
+	}
+	for _, op := range ops {
+		file := &giteaChangeFile{Path: q.option.DB + "/" + op.Key}
+		if existing[op.Key] {
+			file.Sha, _ = q.shaCache.get(op.Key)
+		}
+		if op.Value == nil {
+			if !existing[op.Key] {
+				continue
+			}
+			file.Operation = "delete"
+		} else {
+			file.Operation = "create"
+			if existing[op.Key] {
+				file.Operation = "update"
+			}
+			file.Content = base64.StdEncoding.EncodeToString([]byte(*op.Value))
+		}
+		gcfo.Files = append(gcfo.Files, file)
+	}
+	if len(gcfo.Files) == 0 {
+		return &KeyRecord{}, nil
+	}
+
+	result := &githubPutResult{}
+	repoURL := githubRepoURL(q.option.APIURL, q.option.User, q.option.Repo)
+	if err := q.requestJSON(repoURL+"/contents", "POST", gcfo, result); err != nil {
+		return nil, err
+	}
+	for _, file := range gcfo.Files {
+		// The new sha is unknown, the next write refreshes it
+		q.shaCache.remove(strings.TrimPrefix(file.Path, q.option.DB+"/"))
+	}
+	record := &KeyRecord{}
+	if result.Commit != nil {
+		record.Commit = result.Commit.Sha
+	}
+	return record, nil
+}
@@ -0,0 +1,81 @@
+package kv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newGiteaTestServer fakes the part of the gitea contents API used by GiteaQuerier
+func newGiteaTestServer(t *testing.T) *httptest.Server {
+	files := make(map[string]string)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := "/api/v1/repos/Gcaufy-Test/test-database/contents/"
+		if !strings.HasPrefix(r.URL.Path, prefix) {
+			w.WriteHeader(404)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		content, exist := files[name]
+		switch r.Method {
+		case "GET":
+			if !exist {
+				w.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(w).Encode(&githubKeyRecord{
+				Name:    name[strings.LastIndex(name, "/")+1:],
+				Content: base64.StdEncoding.EncodeToString([]byte(content)),
+				Sha:     content,
+			})
+		case "POST", "PUT":
+			gpo := &githubPutOption{}
+			json.NewDecoder(r.Body).Decode(gpo)
+			if (r.Method == "POST") == exist || (exist && gpo.Sha != content) {
+				w.WriteHeader(422)
+				return
+			}
+			b, _ := base64.StdEncoding.DecodeString(gpo.Content)
+			files[name] = string(b)
+			json.NewEncoder(w).Encode(&githubPutResult{
+				Content: &githubKeyRecord{Name: name[strings.LastIndex(name, "/")+1:], Sha: string(b)},
+				Commit:  &githubCommitInfo{Sha: "abcdef"},
+			})
+		}
+	}))
+}
+
+func TestGiteaQuerier(t *testing.T) {
+	server := newGiteaTestServer(t)
+	defer server.Close()
+
+	// Hosts not known by freedb are routed to gitea
+	kv, err := NewKV("git@gitea.example.com:Gcaufy-Test/test-database.git", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, ok := kv.querier.(*GiteaQuerier)
+	if !ok {
+		t.Fatalf("expect a gitea querier, got %T", kv.querier)
+	}
+	if q.option.APIURL != "https://gitea.example.com/api/v1" {
+		t.Errorf("unexpected api url %s", q.option.APIURL)
+	}
+	kv.UseCache = false
+	kv.Use("golang")
+	kv.SetAPIURL(server.URL + "/api/v1/")
+
+	if _, err = kv.Set("key-exist", "123"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := kv.Append("key-exist", "456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Content != "123456" || record.Commit != "abcdef" {
+		t.Errorf("unexpected record %+v", record)
+	}
+}
@@ -1,35 +1,30 @@
 package kv
 
 import (
-	"bytes"
+	"container/list"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
 // GithubQuerier is a querier for github
 type GithubQuerier struct {
-	baseURL   string
-	option    *QuerierOption
-	shaCache  shaMap
-	retryMap  retryCounter
+	baseURL  string
+	option   *QuerierOption
+	shaCache *shaMap
+	// etags holds the last response of the most recent GET urls, to revalidate it with If-None-Match
+	etags     *etagStore
 	committer *Committer
-}
-
-type githubCommiter struct {
-	name  string `json:"name"`
-	email string `json:"email"`
-}
-type githubError struct {
-	Message string `json:"message"`
-	URL     string `json:"document_url"`
-	Code    int    `json:"code"`
-}
 
-func (e *githubError) Error() string {
-	return fmt.Sprintf("[%d] %s", e.Code, e.Message)
+	// createMethod is the http method to create a file, gitea uses POST
+	createMethod string
+	httpClient
 }
 
 type githubKeyRecord struct {
@@ -60,26 +55,179 @@ type githubPutOption struct {
 	Committer *Committer `json:"committer"`
 }
 
-type shaMap map[string]string
-type retryCounter map[string]int
+type githubRef struct {
+	Object struct {
+		Sha string `json:"sha"`
+	} `json:"object"`
+}
+
+type githubGitObject struct {
+	Sha  string `json:"sha"`
+	Tree struct {
+		Sha string `json:"sha"`
+	} `json:"tree"`
+}
+
+type githubBlobOption struct {
+	Content  string `json:"content"`
+	Encoding string `json:"encoding"`
+}
+
+type githubTreeEntry struct {
+	Path string  `json:"path"`
+	Mode string  `json:"mode"`
+	Type string  `json:"type"`
+	Sha  *string `json:"sha"`
+}
+
+type githubTreeOption struct {
+	BaseTree string             `json:"base_tree"`
+	Tree     []*githubTreeEntry `json:"tree"`
+}
+
+type githubCommitOption struct {
+	Message   string     `json:"message"`
+	Tree      string     `json:"tree"`
+	Parents   []string   `json:"parents"`
+	Author    *Committer `json:"author,omitempty"`
+	Committer *Committer `json:"committer,omitempty"`
+}
+
+type githubRefOption struct {
+	Sha   string `json:"sha"`
+	Force bool   `json:"force"`
+}
+
+type githubCommit struct {
+	Sha    string `json:"sha"`
+	Commit struct {
+		Author struct {
+			Name  string    `json:"name"`
+			Email string    `json:"email"`
+			Date  time.Time `json:"date"`
+		} `json:"author"`
+		Message string `json:"message"`
+	} `json:"commit"`
+}
+
+// etagEntry is a response body and the ETag it was served with
+type etagEntry struct {
+	url  string
+	etag string
+	body []byte
+}
+
+// etagStore holds the etagEntry of the most recently read urls, at most size
+// of them, safe for concurrent use
+type etagStore struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	// order has the most recently used entry first
+	order *list.List
+}
+
+func newEtagStore(size int) *etagStore {
+	return &etagStore{size: size, items: make(map[string]*list.Element), order: list.New()}
+}
+
+func (s *etagStore) get(urlStr string) (*etagEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[urlStr]
+	if !ok {
+		return nil, false
+	}
+	s.order.MoveToFront(el)
+	return el.Value.(*etagEntry), true
+}
+
+// set keeps entry, evicting the least recently used ones over size
+func (s *etagStore) set(urlStr string, entry *etagEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size <= 0 {
+		return
+	}
+	entry.url = urlStr
+	if el, ok := s.items[urlStr]; ok {
+		el.Value = entry
+		s.order.MoveToFront(el)
+		return
+	}
+	s.items[urlStr] = s.order.PushFront(entry)
+	for s.order.Len() > s.size {
+		el := s.order.Back()
+		s.order.Remove(el)
+		delete(s.items, el.Value.(*etagEntry).url)
+	}
+}
+
+func (s *etagStore) remove(urlStr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[urlStr]; ok {
+		s.order.Remove(el)
+		delete(s.items, urlStr)
+	}
+}
+
+func (s *etagStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.order.Len()
+}
 
-// NewGithubQuerier is a querier constructor
+// NewGithubQuerier is a querier constructor. Unless option.APIURL is set, the
+// API base URL is https://api.github.com for github.com, and
+// https://<host>/api/v3 for a GitHub Enterprise Server host.
 func NewGithubQuerier(option *QuerierOption) *GithubQuerier {
+	if option.APIURL == "" {
+		option.APIURL = githubAPIURL(option.Host)
+	}
 	return &GithubQuerier{
-		baseURL:   fmt.Sprintf("https://api.github.com/repos/%s/%s/contents", option.user, option.repo),
-		option:    option,
-		committer: option.committer,
-		shaCache:  make(map[string]string),
-		retryMap:  make(map[string]int),
+		baseURL:      githubBaseURL(option.APIURL, option.User, option.Repo),
+		option:       option,
+		committer:    option.Committer,
+		shaCache:     newShaMap(),
+		etags:        newEtagStore(DefaultCacheSize),
+		createMethod: "PUT",
+		httpClient:   httpClient{limits: &rateLimits{}},
 	}
 }
 
+func githubAPIURL(host string) string {
+	if host == "" || host == "github.com" {
+		return "https://api.github.com"
+	}
+	return "https://" + host + "/api/v3"
+}
+
+// isGithubEnterprise reports whether a host looks like a GitHub Enterprise Server, e.g. github.corp.example
+func isGithubEnterprise(host string) bool {
+	return strings.HasPrefix(host, "github.")
+}
+
+// isGithubAPIURL reports whether an API URL is the REST API of a GitHub
+// Enterprise Server, e.g. https://git.corp.example/api/v3, gitea serves /api/v1
+func isGithubAPIURL(apiURL string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(apiURL, "/"), "/api/v3")
+}
+
+func githubRepoURL(apiURL, user, repo string) string {
+	return fmt.Sprintf("%s/repos/%s/%s", apiURL, user, repo)
+}
+
+func githubBaseURL(apiURL, user, repo string) string {
+	return githubRepoURL(apiURL, user, repo) + "/contents"
+}
+
 // Keys is a function to list all keys
 func (q *GithubQuerier) Keys() (*[]*KeyRecord, error) {
 	record, err := q.listReq()
 	if err != nil {
 		if err.Code == 404 {
-			return nil, fmt.Errorf("Repository not found")
+			return nil, newError(ErrNotFound, "Repository not found")
 		}
 		return nil, err
 	}
@@ -97,59 +245,99 @@ func (q *GithubQuerier) Get(key string) (*KeyRecord, error) {
 	}
 	decodeBytes, _ := base64.StdEncoding.DecodeString(record.Content)
 	record.Content = string(decodeBytes)
-	q.shaCache[record.Name] = record.Sha
+	q.shaCache.set(record.Name, record.Sha)
 	return record.transfer(), nil
 }
 
 // Set is a function to set a key
 func (q *GithubQuerier) Set(key string, value string) (*KeyRecord, error) {
+	return q.set(key, value, false)
+}
+
+// set writes a key, a conflict is retried once with the current sha of the key
+func (q *GithubQuerier) set(key string, value string, retried bool) (*KeyRecord, error) {
 	encoded := base64.StdEncoding.EncodeToString([]byte(value))
 	gpo := &githubPutOption{
 		Content:   encoded,
-		Branch:    q.option.branch,
+		Branch:    q.option.Branch,
 		Message:   "freedb update a key from golang client",
 		Committer: q.committer,
 	}
 
-	sha, ok := q.shaCache[key]
+	method := "PUT"
+	sha, ok := q.shaCache.get(key)
 	if ok { // Try to update a exist record
 		gpo.Sha = sha
 	} else { // Set a new record
+		method = q.createMethod
 		gpo.Message = "freedb create a key from golang client"
 	}
-	record, err := q.putReq(key, gpo)
+	record, err := q.putReq(key, method, gpo)
 	if err != nil {
 		// 409: [409] xxx does not match. which mean sha is wrong
 		// 422: [422] "sha" wasn't supplied.
 		if err.Code == 409 || err.Code == 422 {
-			_, ok := q.retryMap[key]
-			if ok {
-				delete(q.retryMap, key)
-				return nil, fmt.Errorf("Update key \"%s\" failed: %s", key, err)
+			if retried {
+				return nil, newError(ErrConflict, "Update key \"%s\" failed: %s", key, err)
 			}
-			q.retryMap[key] = 1
 			_, getErr := q.Get(key) // Update sha for the key
 			if getErr != nil {
-				return nil, fmt.Errorf("Get key \"%s\" failed: %s", key, getErr)
+				return nil, fmt.Errorf("Get key \"%s\" failed: %w", key, getErr)
+			}
+			return q.set(key, value, true)
+		}
+		return nil, err
+	}
+	q.shaCache.set(record.Name, record.Sha)
+	return record.transfer(), nil
+}
+
+// SetIfMatch is a function to set a key only if it still matches expected
+func (q *GithubQuerier) SetIfMatch(key string, value string, expected string) (*KeyRecord, error) {
+	gpo := &githubPutOption{
+		Content:   base64.StdEncoding.EncodeToString([]byte(value)),
+		Branch:    q.option.Branch,
+		Message:   "freedb create a key from golang client",
+		Committer: q.committer,
+	}
+	method := q.createMethod
+	if expected != "" {
+		method = "PUT"
+		gpo.Message = "freedb update a key from golang client"
+		gpo.Sha = expected
+		// expected may be a commit, then the key must have the sha it had in that commit
+		if sha, _ := q.shaCache.get(key); sha != expected {
+			if record, err := q.getReqAt(key, expected); err == nil {
+				gpo.Sha = record.Sha
 			}
-			kr, setErr := q.Set(key, value)
-			delete(q.retryMap, key)
-			return kr, setErr
+		}
+	}
+	record, err := q.putReq(key, method, gpo)
+	if err != nil {
+		// 409: the sha does not match, 422: the key exists but no sha is supplied
+		if err.Code == 409 || err.Code == 422 {
+			q.shaCache.remove(key)
+			return nil, &ConflictError{Key: key, Expected: expected}
 		}
 		return nil, err
 	}
-	q.shaCache[record.Name] = record.Sha
+	q.shaCache.set(record.Name, record.Sha)
 	return record.transfer(), nil
 }
 
 // Delete is a function to delete a key
 func (q *GithubQuerier) Delete(key string) (*KeyRecord, error) {
+	return q.delete(key, false)
+}
+
+// delete removes a key, a conflict is retried once with the current sha of the key
+func (q *GithubQuerier) delete(key string, retried bool) (*KeyRecord, error) {
 	gpo := &githubPutOption{
-		Branch:    q.option.branch,
+		Branch:    q.option.Branch,
 		Message:   "freedb delete a key from golang client",
 		Committer: q.committer,
 	}
-	sha, ok := q.shaCache[key]
+	sha, ok := q.shaCache.get(key)
 	if ok {
 		gpo.Sha = sha
 	}
@@ -159,65 +347,308 @@ func (q *GithubQuerier) Delete(key string) (*KeyRecord, error) {
 		// 409: [409] xxx does not match. which mean sha is wrong
 		// 422: [422] "sha" wasn't supplied.
 		if err.Code == 409 || err.Code == 422 {
-			_, ok := q.retryMap[key]
-			if ok {
-				delete(q.retryMap, key)
-				return nil, fmt.Errorf("Update key \"%s\" failed: %s", key, err)
+			if retried {
+				return nil, newError(ErrConflict, "Update key \"%s\" failed: %s", key, err)
 			}
-			q.retryMap[key] = 1
 			getKr, getErr := q.Get(key) // Update sha for the key
 			if getErr != nil {
-				return nil, fmt.Errorf("Get key \"%s\" failed: %s", key, getErr)
+				return nil, fmt.Errorf("Get key \"%s\" failed: %w", key, getErr)
 			}
 			if getKr.Name == "" { // The key do not exist, can not delete it
-
-				delete(q.retryMap, key)
 				return &KeyRecord{}, nil
 			}
-			kr, setErr := q.Delete(key)
-			delete(q.retryMap, key)
-			return kr, setErr
+			return q.delete(key, true)
 		}
 		return nil, err
 	}
-	delete(q.shaCache, key)
+	q.shaCache.remove(key)
 	return record.transfer(), nil
 }
 
-func (q *GithubQuerier) setHost(user, repo string) {
-	q.baseURL = fmt.Sprintf("https://api.github.com/repos/%s/%s/contents", user, repo)
-	q.option.user = user
-	q.option.repo = repo
+// Batch is a function to write several keys in one commit with the git data API.
+// The branch is moved with a fast-forward update, so concurrent commits are
+// never overwritten: if the branch moves in the meantime, the batch is
+// rebuilt once on top of the new head.
+func (q *GithubQuerier) Batch(ops []*BatchOp) (*KeyRecord, error) {
+	var err *httpError
+	for i := 0; i < 2; i++ {
+		var commit string
+		commit, err = q.batchReq(ops, "")
+		if err == nil {
+			return &KeyRecord{Commit: commit}, nil
+		}
+		// 422: Update is not a fast forward
+		if err.Code != 422 {
+			break
+		}
+	}
+	return nil, err
 }
-func (q *GithubQuerier) setBranch(branch string) {
-	q.option.branch = branch
+
+// Head is a function to get the commit the branch points to
+func (q *GithubQuerier) Head() (string, error) {
+	repoURL := githubRepoURL(q.option.APIURL, q.option.User, q.option.Repo)
+	head := &githubRef{}
+	if err := q.requestJSON(repoURL+"/git/refs/heads/"+q.option.Branch, "GET", nil, head); err != nil {
+		if err.Code == 404 {
+			return "", nil
+		}
+		return "", err
+	}
+	return head.Object.Sha, nil
 }
-func (q *GithubQuerier) use(db string) {
-	q.option.db = db
+
+// BatchOn is a function to write several keys in one commit whose parent is
+// head, it is never rebuilt on top of another commit
+func (q *GithubQuerier) BatchOn(ops []*BatchOp, head string) (*KeyRecord, error) {
+	commit, err := q.batchReq(ops, head)
+	if err != nil {
+		// 422: Update is not a fast forward
+		if err.Code == 422 {
+			return nil, q.movedError(head)
+		}
+		return nil, err
+	}
+	return &KeyRecord{Commit: commit}, nil
 }
-func (q *GithubQuerier) setToken(token string) {
-	q.option.token = token
+
+func (q *GithubQuerier) movedError(head string) *httpError {
+	return &httpError{Code: 409, Message: fmt.Sprintf("Branch \"%s\" has moved since %s", q.option.Branch, head)}
 }
 
-func (q *GithubQuerier) listReq() (*[]*KeyRecord, *githubError) {
+// batchReq commits ops on top of the branch, which must point to expected unless it is empty
+func (q *GithubQuerier) batchReq(ops []*BatchOp, expected string) (string, *httpError) {
+	repoURL := githubRepoURL(q.option.APIURL, q.option.User, q.option.Repo)
+	refURL := repoURL + "/git/refs/heads/" + q.option.Branch
+
+	head := &githubRef{}
+	if err := q.requestJSON(refURL, "GET", nil, head); err != nil {
+		return "", err
+	}
+	if expected != "" && head.Object.Sha != expected {
+		return "", q.movedError(expected)
+	}
+	parent := &githubGitObject{}
+	if err := q.requestJSON(repoURL+"/git/commits/"+head.Object.Sha, "GET", nil, parent); err != nil {
+		return "", err
+	}
+	// Deleting a missing path fails the whole tree, list existing keys first
+	existing, err := q.existingKeys(ops)
+	if err != nil {
+		return "", err
+	}
+
+	tree := &githubTreeOption{BaseTree: parent.Tree.Sha}
+	for _, op := range ops {
+		entry := &githubTreeEntry{Path: q.option.DB + "/" + op.Key, Mode: "100644", Type: "blob"}
+		if op.Value == nil {
+			if !existing[op.Key] {
+				continue
+			}
+		} else {
+			blob := &githubGitObject{}
+			err := q.requestJSON(repoURL+"/git/blobs", "POST", &githubBlobOption{
+				Content:  base64.StdEncoding.EncodeToString([]byte(*op.Value)),
+				Encoding: "base64",
+			}, blob)
+			if err != nil {
+				return "", err
+			}
+			entry.Sha = &blob.Sha
+		}
+		tree.Tree = append(tree.Tree, entry)
+	}
+	if len(tree.Tree) == 0 {
+		return head.Object.Sha, nil
+	}
+	newTree := &githubGitObject{}
+	if err := q.requestJSON(repoURL+"/git/trees", "POST", tree, newTree); err != nil {
+		return "", err
+	}
+	commit := &githubGitObject{}
+	err = q.requestJSON(repoURL+"/git/commits", "POST", &githubCommitOption{
+		Message:   fmt.Sprintf("freedb update %d keys from golang client", len(tree.Tree)),
+		Tree:      newTree.Sha,
+		Parents:   []string{head.Object.Sha},
+		Author:    q.committer,
+		Committer: q.committer,
+	}, commit)
+	if err != nil {
+		return "", err
+	}
+	if err = q.requestJSON(refURL, "PATCH", &githubRefOption{Sha: commit.Sha}, nil); err != nil {
+		return "", err
+	}
+
+	for _, entry := range tree.Tree {
+		key := strings.TrimPrefix(entry.Path, q.option.DB+"/")
+		if entry.Sha == nil {
+			q.shaCache.remove(key)
+		} else {
+			q.shaCache.set(key, *entry.Sha)
+		}
+	}
+	return commit.Sha, nil
+}
+
+// existingKeys lists the keys in the database if any op deletes a key
+func (q *GithubQuerier) existingKeys(ops []*BatchOp) (map[string]bool, *httpError) {
+	existing := make(map[string]bool)
+	if !hasDelete(ops) {
+		return existing, nil
+	}
+	krl, err := q.listReq()
+	if err != nil {
+		if err.Code == 404 { // The database does not exist yet
+			return existing, nil
+		}
+		return nil, err
+	}
+	for _, kr := range *krl {
+		existing[kr.Name] = true
+	}
+	return existing, nil
+}
+
+// History is a function to list the commits which touched a key
+func (q *GithubQuerier) History(key string) ([]*Revision, error) {
+	repoURL := githubRepoURL(q.option.APIURL, q.option.User, q.option.Repo)
+	query := url.Values{}
+	query.Set("path", strings.TrimSuffix(q.option.DB+"/"+key, "/"))
+	query.Set("sha", q.option.Branch)
+	query.Set("per_page", "100")
+
+	history := []*Revision{}
+	for page := 1; ; page++ {
+		query.Set("page", fmt.Sprint(page))
+		var commits []*githubCommit
+		if err := q.requestJSON(repoURL+"/commits?"+query.Encode(), "GET", nil, &commits); err != nil {
+			return nil, err
+		}
+		for _, commit := range commits {
+			history = append(history, commit.transfer())
+		}
+		if len(commits) < 100 {
+			return history, nil
+		}
+	}
+}
+
+// GetAt is a function to read a key at a commit, a tag or a branch
+func (q *GithubQuerier) GetAt(key string, ref string) (*KeyRecord, error) {
+	record, err := q.getReqAt(key, ref)
+	if err != nil {
+		if err.Code == 404 {
+			return &KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	decodeBytes, _ := base64.StdEncoding.DecodeString(record.Content)
+	record.Content = string(decodeBytes)
+	return record.transfer(), nil
+}
+
+// KeysAt is a function to list all keys at a commit, a tag or a branch
+func (q *GithubQuerier) KeysAt(ref string) (*[]*KeyRecord, error) {
+	record, err := q.listReqAt(ref)
+	if err != nil {
+		if err.Code == 404 {
+			// The database folder did not exist yet
+			return &[]*KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// SetHost is a function to update the repository
+func (q *GithubQuerier) SetHost(user, repo string) {
+	q.baseURL = githubBaseURL(q.option.APIURL, user, repo)
+	q.option.User = user
+	q.option.Repo = repo
+}
+
+// SetAPIURL is a function to update the API base URL
+func (q *GithubQuerier) SetAPIURL(apiURL string) {
+	q.baseURL = githubBaseURL(apiURL, q.option.User, q.option.Repo)
+	q.option.APIURL = apiURL
+}
+
+// SetBranch is a function to update the branch
+func (q *GithubQuerier) SetBranch(branch string) {
+	q.option.Branch = branch
+}
+
+// Use is a function to change database
+func (q *GithubQuerier) Use(db string) {
+	q.option.DB = db
+}
+
+// SetToken is a function to update the token
+func (q *GithubQuerier) SetToken(token string) {
+	q.option.Token = token
+}
+
+// Option is a function to get the current option
+func (q *GithubQuerier) Option() *QuerierOption {
+	return q.option
+}
+
+// RateLimit is a function to get the rate limit reported by the last response
+func (q *GithubQuerier) RateLimit() (*RateLimit, error) {
+	return q.rateLimit(func() *httpError {
+		_, err := q.request(githubRepoURL(q.option.APIURL, q.option.User, q.option.Repo), "GET", nil)
+		return err
+	})
+}
+
+// WithContext is a function to get a copy of the querier whose requests are cancelled when ctx is done
+func (q *GithubQuerier) WithContext(ctx context.Context) Querier {
+	c := *q
+	c.ctx = ctx
+	return &c
+}
+
+func (q *GithubQuerier) listReq() (*[]*KeyRecord, *httpError) {
 	body, err := q.query("", "GET", nil)
 	if err != nil {
 		return nil, err
 	}
+	return q.decodeList(body, true)
+}
+
+// listReqAt lists the keys at a ref, which can be a branch, a tag or a commit
+func (q *GithubQuerier) listReqAt(ref string) (*[]*KeyRecord, *httpError) {
+	body, err := q.request(q.contentsURL("")+"?ref="+url.QueryEscape(ref), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	return q.decodeList(body, false)
+}
+
+// decodeList decodes a folder listing, cacheSha remembers the sha of every key for the next write
+func (q *GithubQuerier) decodeList(body *[]byte, cacheSha bool) (*[]*KeyRecord, *httpError) {
 	var gkrl []*githubKeyRecord
 	decodeErr := json.Unmarshal(*body, &gkrl)
 	if decodeErr != nil {
-		return nil, &githubError{Message: decodeErr.Error()}
+		return nil, &httpError{Message: decodeErr.Error()}
 	}
 	var krl []*KeyRecord
 	for _, gkr := range gkrl {
-		q.shaCache[gkr.Name] = gkr.Sha
+		if cacheSha {
+			q.shaCache.set(gkr.Name, gkr.Sha)
+		}
 		krl = append(krl, gkr.transfer())
 	}
 	return &krl, nil
 }
-func (q *GithubQuerier) getReq(key string) (*githubKeyRecord, *githubError) {
-	body, err := q.query(key, "GET", nil)
+func (q *GithubQuerier) getReq(key string) (*githubKeyRecord, *httpError) {
+	return q.getReqAt(key, q.option.Branch)
+}
+
+// getReqAt reads a key at a ref, which can be a branch, a tag or a commit
+func (q *GithubQuerier) getReqAt(key string, ref string) (*githubKeyRecord, *httpError) {
+	body, err := q.request(q.contentsURL(key)+"?ref="+url.QueryEscape(ref), "GET", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -227,26 +658,26 @@ func (q *GithubQuerier) getReq(key string) (*githubKeyRecord, *githubError) {
 		var gkrl []*githubKeyRecord
 		decodeErr := json.Unmarshal(*body, &gkrl)
 		if decodeErr == nil {
-			return nil, &githubError{Message: fmt.Sprintf("'%s' is a folder", key)}
+			return nil, &httpError{Message: fmt.Sprintf("'%s' is a folder", key), err: ErrIsFolder}
 		}
-		return nil, &githubError{Message: decodeErr.Error()}
+		return nil, &httpError{Message: decodeErr.Error()}
 	}
 	return kr, nil
 }
-func (q *GithubQuerier) putReq(key string, gpo *githubPutOption) (*githubKeyRecord, *githubError) {
-	body, err := q.query(key, "PUT", gpo)
+func (q *GithubQuerier) putReq(key string, method string, gpo *githubPutOption) (*githubKeyRecord, *httpError) {
+	body, err := q.query(key, method, gpo)
 	if err != nil {
 		return nil, err
 	}
 	gpr := &githubPutResult{}
 	decodeErr := json.Unmarshal(*body, gpr)
 	if decodeErr != nil {
-		return nil, &githubError{Message: decodeErr.Error()}
+		return nil, &httpError{Message: decodeErr.Error()}
 	}
 	return gpr.transfer(), nil
 }
 
-func (q *GithubQuerier) deleteReq(key string, gpo *githubPutOption) (*githubKeyRecord, *githubError) {
+func (q *GithubQuerier) deleteReq(key string, gpo *githubPutOption) (*githubKeyRecord, *httpError) {
 	body, err := q.query(key, "DELETE", gpo)
 	if err != nil {
 		return nil, err
@@ -254,59 +685,88 @@ func (q *GithubQuerier) deleteReq(key string, gpo *githubPutOption) (*githubKeyR
 	gpr := &githubPutResult{}
 	decodeErr := json.Unmarshal(*body, gpr)
 	if decodeErr != nil {
-		return nil, &githubError{Message: decodeErr.Error()}
+		return nil, &httpError{Message: decodeErr.Error()}
 	}
 	return &githubKeyRecord{
 		Commit: gpr.Commit.Sha,
 	}, nil
 }
 
-func (q *GithubQuerier) query(key string, method string, data *githubPutOption) (*[]byte, *githubError) {
-	urlStr := q.baseURL + "/" + q.option.db
+func (q *GithubQuerier) contentsURL(key string) string {
+	urlStr := q.baseURL + "/" + q.option.DB
 	if key != "" {
 		urlStr += "/" + key
 	}
-	var req *http.Request
-	var err error
+	return urlStr
+}
+
+func (q *GithubQuerier) query(key string, method string, data *githubPutOption) (*[]byte, *httpError) {
+	urlStr := q.contentsURL(key)
+	if method == "GET" {
+		urlStr += "?ref=" + url.QueryEscape(q.option.Branch)
+	}
+	var body interface{}
 	if data != nil {
-		body := new(bytes.Buffer)
-		json.NewEncoder(body).Encode(data)
-		req, err = http.NewRequest(method, urlStr, body)
-		req.Header.Set("Content-Type", "application/json")
-	} else {
-		req, err = http.NewRequest(method, urlStr, nil)
+		body = data
+	}
+	respBody, err := q.request(urlStr, method, body)
+	if err != nil && err.Code == 404 && key == "" {
+		err.Message = "Invalid repository"
 	}
+	return respBody, err
+}
+
+// requestJSON sends data and decodes the response into result, a nil result skips decoding
+func (q *GithubQuerier) requestJSON(urlStr string, method string, data interface{}, result interface{}) *httpError {
+	body, err := q.request(urlStr, method, data)
 	if err != nil {
-		return nil, &githubError{Message: err.Error()}
+		return err
+	}
+	if result == nil {
+		return nil
 	}
-	req.Header.Set("User-Agent", "freedb")
-	req.Header.Set("Authorization", "token "+q.option.token)
+	decodeErr := json.Unmarshal(*body, result)
+	if decodeErr != nil {
+		return &httpError{Message: decodeErr.Error()}
+	}
+	return nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+func (q *GithubQuerier) request(urlStr string, method string, data interface{}) (*[]byte, *httpError) {
+	req, err := q.newJSONRequest(method, urlStr, data)
 	if err != nil {
-		return nil, &githubError{Message: err.Error()}
+		return nil, err
+	}
+	req.Header.Set("Authorization", "token "+q.option.Token)
+	// A 304 response does not count against the rate limit
+	cached, revalidate := q.etags.get(urlStr)
+	if method == "GET" && revalidate {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := q.send(q.option, req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == 401 {
-		return nil, &githubError{Code: 401, Message: "Invalid token"}
-	} else if resp.StatusCode == 404 {
-		if key == "" {
-			return nil, &githubError{Code: 404, Message: "Invalid repository"}
-		}
-		return nil, &githubError{Code: 404, Message: "Invalid repository or invalid key"}
+	if resp.StatusCode == 304 && method == "GET" && revalidate {
+		body := append([]byte{}, cached.body...)
+		return &body, nil
+	}
+	if method == "GET" {
+		q.etags.remove(urlStr)
 	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
 	if resp.StatusCode > 299 {
-		gitErr := &githubError{}
-		respBody, _ := ioutil.ReadAll(resp.Body)
-		err = json.Unmarshal(respBody, &gitErr)
-		gitErr.Code = resp.StatusCode
-		if err != nil {
-			return nil, gitErr
+		var errBody struct {
+			Message string `json:"message"`
 		}
-		return nil, gitErr
+		json.Unmarshal(respBody, &errBody)
+		return nil, statusError(resp, errBody.Message)
+	}
+	if etag := resp.Header.Get("ETag"); method == "GET" && etag != "" {
+		q.etags.set(urlStr, &etagEntry{etag: etag, body: append([]byte{}, respBody...)})
 	}
-	respBody, _ := ioutil.ReadAll(resp.Body)
 
 	/*
 		fmt.Println(urlStr)
@@ -323,7 +783,9 @@ func (gpr *githubPutResult) transfer() *githubKeyRecord {
 		Size:    gpr.Content.Size,
 		RawURL:  gpr.Content.RawURL,
 		HTMLURL: gpr.Content.HTMLURL,
+		Sha:     gpr.Content.Sha,
 		Commit:  gpr.Commit.Sha,
+		Path:    gpr.Content.Path,
 	}
 }
 
@@ -334,6 +796,18 @@ func (gkr *githubKeyRecord) transfer() *KeyRecord {
 		Size:    gkr.Size,
 		RawURL:  gkr.RawURL,
 		HTMLURL: gkr.HTMLURL,
+		Sha:     gkr.Sha,
 		Commit:  gkr.Commit,
+		Path:    gkr.Path,
+	}
+}
+
+func (gc *githubCommit) transfer() *Revision {
+	return &Revision{
+		Commit:  gc.Sha,
+		Author:  gc.Commit.Author.Name,
+		Email:   gc.Commit.Author.Email,
+		Date:    gc.Commit.Author.Date,
+		Message: gc.Commit.Message,
 	}
 }
@@ -0,0 +1,337 @@
+package kv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// githubTestRepo fakes the part of the github contents and git data APIs used by GithubQuerier
+type githubTestRepo struct {
+	head    string
+	commits map[string]*githubTestCommit
+	trees   map[string]map[string]string
+	n       int
+}
+
+type githubTestCommit struct {
+	tree   string
+	parent string
+}
+
+func newGithubTestServer(t *testing.T) (*httptest.Server, *githubTestRepo) {
+	repo := &githubTestRepo{
+		head:    "commit-0",
+		commits: map[string]*githubTestCommit{"commit-0": {tree: "tree-0"}},
+		trees:   map[string]map[string]string{"tree-0": {}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/repos/Gcaufy-Test/test-database")
+		files := repo.trees[repo.commits[repo.head].tree]
+		repo.n++
+		id := fmt.Sprint(repo.n)
+		switch {
+		case r.Method == "GET" && strings.HasPrefix(path, "/contents/"):
+			dir := strings.TrimPrefix(path, "/contents/") + "/"
+			var list []*githubKeyRecord
+			for name, content := range files {
+				if strings.HasPrefix(name, dir) {
+					list = append(list, &githubKeyRecord{Name: strings.TrimPrefix(name, dir), Sha: content})
+				}
+			}
+			if len(list) == 0 {
+				w.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(w).Encode(list)
+		case r.Method == "GET" && path == "/git/refs/heads/master":
+			fmt.Fprintf(w, `{"object": {"sha": "%s"}}`, repo.head)
+		case r.Method == "GET" && strings.HasPrefix(path, "/git/commits/"):
+			fmt.Fprintf(w, `{"tree": {"sha": "%s"}}`, repo.commits[strings.TrimPrefix(path, "/git/commits/")].tree)
+		case r.Method == "POST" && path == "/git/blobs":
+			blob := &githubBlobOption{}
+			json.NewDecoder(r.Body).Decode(blob)
+			content, _ := base64.StdEncoding.DecodeString(blob.Content)
+			fmt.Fprintf(w, `{"sha": "%s"}`, content)
+		case r.Method == "POST" && path == "/git/trees":
+			tree := &githubTreeOption{}
+			json.NewDecoder(r.Body).Decode(tree)
+			newTree := make(map[string]string)
+			for name, content := range repo.trees[tree.BaseTree] {
+				newTree[name] = content
+			}
+			for _, entry := range tree.Tree {
+				if _, ok := newTree[entry.Path]; !ok && entry.Sha == nil {
+					w.WriteHeader(422)
+					return
+				}
+				if entry.Sha == nil {
+					delete(newTree, entry.Path)
+				} else {
+					newTree[entry.Path] = *entry.Sha
+				}
+			}
+			repo.trees["tree-"+id] = newTree
+			fmt.Fprintf(w, `{"sha": "tree-%s"}`, id)
+		case r.Method == "POST" && path == "/git/commits":
+			commit := &githubCommitOption{}
+			json.NewDecoder(r.Body).Decode(commit)
+			repo.commits["commit-"+id] = &githubTestCommit{tree: commit.Tree, parent: commit.Parents[0]}
+			fmt.Fprintf(w, `{"sha": "commit-%s"}`, id)
+		case r.Method == "PATCH" && path == "/git/refs/heads/master":
+			ref := &githubRefOption{}
+			json.NewDecoder(r.Body).Decode(ref)
+			if repo.commits[ref.Sha].parent != repo.head {
+				w.WriteHeader(422)
+				w.Write([]byte(`{"message": "Update is not a fast forward"}`))
+				return
+			}
+			repo.head = ref.Sha
+			fmt.Fprintf(w, `{"object": {"sha": "%s"}}`, repo.head)
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(404)
+		}
+	}))
+	return server, repo
+}
+
+func TestGithubEnterpriseHost(t *testing.T) {
+	kv, err := NewKV("https://github.corp.example/Gcaufy-Test/test-database.git", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, ok := kv.querier.(*GithubQuerier)
+	if !ok {
+		t.Fatalf("expect a github querier, got %T", kv.querier)
+	}
+	if q.baseURL != "https://github.corp.example/api/v3/repos/Gcaufy-Test/test-database/contents" {
+		t.Errorf("unexpected base url %s", q.baseURL)
+	}
+	kv.SetAPIURL("https://git.corp.example/api/v3/")
+	if q.baseURL != "https://git.corp.example/api/v3/repos/Gcaufy-Test/test-database/contents" {
+		t.Errorf("unexpected base url %s", q.baseURL)
+	}
+
+	kv, _ = NewKV("git@github.com:Gcaufy-Test/test-database.git", "token")
+	if q := kv.querier.(*GithubQuerier); q.option.APIURL != "https://api.github.com" {
+		t.Errorf("unexpected api url %s", q.option.APIURL)
+	}
+
+	// Any other host is told from gitea by its API URL
+	kv, _ = NewKV("git@git.corp.example:team/config.git", "token")
+	if _, ok := kv.querier.(*GiteaQuerier); !ok {
+		t.Fatalf("expect a gitea querier, got %T", kv.querier)
+	}
+	kv.SetAPIURL("https://git.corp.example/api/v3")
+	q, ok = kv.querier.(*GithubQuerier)
+	if !ok || q.createMethod != "PUT" || q.baseURL != "https://git.corp.example/api/v3/repos/team/config/contents" {
+		t.Errorf("expect a github querier, got %T", kv.querier)
+	}
+	kv, _ = NewKVWithOption("git@git.corp.example:team/config.git", &QuerierOption{APIURL: "https://git.corp.example/api/v3"})
+	if _, ok := kv.querier.(*GithubQuerier); !ok {
+		t.Errorf("expect a github querier, got %T", kv.querier)
+	}
+}
+
+func TestGithubBatch(t *testing.T) {
+	server, repo := newGithubTestServer(t)
+	defer server.Close()
+
+	kv, _ := NewKV("git@github.com:Gcaufy-Test/test-database.git", "token")
+	kv.SetAPIURL(server.URL)
+	kv.Use("golang")
+
+	record, err := kv.Batch().Set("a", "1").Set("b", "2").Set("c", "3").Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Commit != repo.head {
+		t.Errorf("expect commit %s, got %s", repo.head, record.Commit)
+	}
+	parent := repo.head
+	// Deleting a missing key is skipped instead of failing the tree
+	record, err = kv.Batch().Delete("a").Set("b", "4").Delete("missing").Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := repo.trees[repo.commits[record.Commit].tree]
+	if repo.commits[record.Commit].parent != parent || len(files) != 2 || files["golang/b"] != "4" {
+		t.Errorf("unexpected tree %v", files)
+	}
+
+	// A batch on a head is not rebuilt once the branch moved
+	q := kv.querier.(*GithubQuerier)
+	head, err := q.Head()
+	if err != nil || head != repo.head {
+		t.Fatalf("expect head %s, got %s %v", repo.head, head, err)
+	}
+	kv.Batch().Set("c", "5").Exec()
+	value := "6"
+	if _, err = q.BatchOn([]*BatchOp{{Key: "c", Value: &value}}, head); !errors.Is(err, ErrConflict) {
+		t.Errorf("expect a batch on a stale head to conflict, got %v", err)
+	}
+	if record, err = q.BatchOn([]*BatchOp{{Key: "c", Value: &value}}, repo.head); err != nil || repo.head != record.Commit {
+		t.Errorf("expect a batch on the head, got %v %v", record, err)
+	}
+}
+
+func TestGithubHistory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.URL.Path != "/repos/Gcaufy-Test/test-database/commits" || query.Get("path") != "golang/key" || query.Get("sha") != "test" {
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(404)
+			return
+		}
+		count := 100
+		if query.Get("page") == "2" {
+			count = 1
+		}
+		var commits []string
+		for i := 0; i < count; i++ {
+			commits = append(commits, fmt.Sprintf(`{"sha": "commit-%s-%d", "commit": {"author": {"name": "freedb", "date": "2019-07-01T10:00:00Z"}, "message": "update"}}`, query.Get("page"), i))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(commits, ","))
+	}))
+	defer server.Close()
+
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(server.URL)
+	kv.SetBranch("test")
+	kv.Use("golang")
+	history, err := kv.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 101 || history[100].Commit != "commit-2-0" || history[0].Author != "freedb" || history[0].Date.Year() != 2019 {
+		t.Errorf("unexpected history of %d commits, first %+v", len(history), history[0])
+	}
+}
+
+func TestGithubRevalidate(t *testing.T) {
+	content := "v1"
+	var fresh, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/Gcaufy-Test/test-database/contents/golang/key" {
+			w.WriteHeader(404)
+			return
+		}
+		etag := `"` + content + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(304)
+			return
+		}
+		fresh++
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"name": "key", "sha": "%s", "content": "%s"}`, content, base64.StdEncoding.EncodeToString([]byte(content)))
+	}))
+	defer server.Close()
+
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(server.URL)
+	kv.Use("golang")
+	kv.SetCacheMode(CacheRevalidate)
+	for i := 0; i < 2; i++ {
+		if record, err := kv.Get("key"); err != nil || record.Content != "v1" {
+			t.Fatalf("expect v1, got %v %v", record, err)
+		}
+	}
+	if fresh != 1 || notModified != 1 {
+		t.Errorf("expect 1 full and 1 conditional request, got %d and %d", fresh, notModified)
+	}
+
+	// A changed key is read again
+	content = "v2"
+	if record, err := kv.Get("key"); err != nil || record.Content != "v2" {
+		t.Fatalf("expect v2, got %v %v", record, err)
+	}
+	if fresh != 2 {
+		t.Errorf("expect 2 full requests, got %d", fresh)
+	}
+
+	// The cache is trusted without requests
+	kv.SetCacheMode(CacheAlways)
+	kv.Get("key")
+	if fresh+notModified != 3 {
+		t.Errorf("expect no request, got %d", fresh+notModified-3)
+	}
+}
+
+func TestEtagStoreBound(t *testing.T) {
+	s := newEtagStore(2)
+	s.set("a", &etagEntry{etag: "1"})
+	s.set("b", &etagEntry{etag: "2"})
+	s.get("a")
+	s.set("c", &etagEntry{etag: "3"})
+	if _, ok := s.get("b"); ok || s.len() != 2 {
+		t.Errorf("expect the least recently used url to be evicted, got %d entries", s.len())
+	}
+	if entry, ok := s.get("a"); !ok || entry.etag != "1" {
+		t.Errorf("expect a to be kept, got %v", entry)
+	}
+}
+
+// testTransport sends every request to a test server
+type testTransport struct {
+	server *httptest.Server
+	n      int
+}
+
+func (tr *testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.n++
+	u, _ := url.Parse(tr.server.URL)
+	req.URL.Scheme = u.Scheme
+	req.URL.Host = u.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestGithubHTTPClient(t *testing.T) {
+	server, _ := newGithubTestServer(t)
+	defer server.Close()
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &testTransport{server: server}
+	kv.SetTransport(transport)
+	if _, err := kv.Batch().Set("key", "1").Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if transport.n == 0 {
+		t.Error("expect the requests to go through the transport")
+	}
+
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	option := &QuerierOption{HTTPClient: &http.Client{Timeout: 50 * time.Millisecond}}
+	kv, err = NewKVWithOption("git@github.com:Gcaufy-Test/test-database.git", option)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(slow.URL)
+	if _, err := kv.Get("key"); err == nil || !isUnreachable(err) {
+		t.Errorf("expect the request to time out, got %v", err)
+	}
+	if option.DB != "" {
+		t.Errorf("expect the option to be copied, got %v", option)
+	}
+}
@@ -0,0 +1,531 @@
+package kv
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// GitlabQuerier is a querier for gitlab
+type GitlabQuerier struct {
+	baseURL   string
+	option    *QuerierOption
+	shaCache  *shaMap
+	committer *Committer
+	httpClient
+}
+
+type gitlabKeyRecord struct {
+	FileName     string `json:"file_name"`
+	FilePath     string `json:"file_path"`
+	Size         int    `json:"size"`
+	Encoding     string `json:"encoding"`
+	Content      string `json:"content"`
+	Ref          string `json:"ref"`
+	BlobID       string `json:"blob_id"`
+	CommitID     string `json:"commit_id"`
+	LastCommitID string `json:"last_commit_id"`
+}
+
+type gitlabTreeRecord struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Path string `json:"path"`
+}
+
+type gitlabCommitAction struct {
+	Action   string `json:"action"`
+	FilePath string `json:"file_path"`
+	Content  string `json:"content,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type gitlabCommitOption struct {
+	Branch        string                `json:"branch"`
+	CommitMessage string                `json:"commit_message"`
+	AuthorName    string                `json:"author_name,omitempty"`
+	AuthorEmail   string                `json:"author_email,omitempty"`
+	Actions       []*gitlabCommitAction `json:"actions"`
+}
+
+type gitlabCommitInfo struct {
+	ID string `json:"id"`
+}
+
+type gitlabCommit struct {
+	ID           string    `json:"id"`
+	AuthorName   string    `json:"author_name"`
+	AuthorEmail  string    `json:"author_email"`
+	AuthoredDate time.Time `json:"authored_date"`
+	Message      string    `json:"message"`
+}
+
+type gitlabPutOption struct {
+	Branch        string `json:"branch"`
+	Content       string `json:"content,omitempty"`
+	Encoding      string `json:"encoding,omitempty"`
+	CommitMessage string `json:"commit_message"`
+	AuthorName    string `json:"author_name,omitempty"`
+	AuthorEmail   string `json:"author_email,omitempty"`
+	LastCommitID  string `json:"last_commit_id,omitempty"`
+}
+
+// NewGitlabQuerier is a querier constructor
+func NewGitlabQuerier(option *QuerierOption) *GitlabQuerier {
+	if option.APIURL == "" {
+		option.APIURL = "https://gitlab.com/api/v4"
+	}
+	return &GitlabQuerier{
+		baseURL:    gitlabBaseURL(option.APIURL, option.User, option.Repo),
+		option:     option,
+		committer:  option.Committer,
+		shaCache:   newShaMap(),
+		httpClient: httpClient{limits: &rateLimits{}},
+	}
+}
+
+func gitlabBaseURL(apiURL, user, repo string) string {
+	return fmt.Sprintf("%s/projects/%s", apiURL, url.PathEscape(user+"/"+repo))
+}
+
+// Keys is a function to list all keys
+func (q *GitlabQuerier) Keys() (*[]*KeyRecord, error) {
+	record, err := q.listReq()
+	if err != nil {
+		if err.Code == 404 {
+			return nil, newError(ErrNotFound, "Repository not found")
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// Get is a function to read a key
+func (q *GitlabQuerier) Get(key string) (*KeyRecord, error) {
+	record, err := q.getReq(key, q.option.Branch)
+	if err != nil {
+		if err.Code == 404 {
+			return &KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	decodeBytes, _ := base64.StdEncoding.DecodeString(record.Content)
+	record.Content = string(decodeBytes)
+	q.shaCache.set(record.FileName, record.LastCommitID)
+	return record.transfer(), nil
+}
+
+// Set is a function to set a key
+func (q *GitlabQuerier) Set(key string, value string) (*KeyRecord, error) {
+	return q.set(key, value, false)
+}
+
+// set writes a key, a conflict is retried once with the current sha of the key
+func (q *GitlabQuerier) set(key string, value string, retried bool) (*KeyRecord, error) {
+	gpo := q.putOption("freedb update a key from golang client")
+	gpo.Content = base64.StdEncoding.EncodeToString([]byte(value))
+	gpo.Encoding = "base64"
+
+	method := "PUT"
+	lastCommit, ok := q.shaCache.get(key)
+	if ok { // Try to update a exist record
+		gpo.LastCommitID = lastCommit
+	} else { // Set a new record
+		method = "POST"
+		gpo.CommitMessage = "freedb create a key from golang client"
+	}
+	_, err := q.query(q.fileURL(key), method, gpo)
+	if err != nil {
+		// 400: the file already exists, does not exist, or has been changed
+		// since last_commit_id. All of them mean our cache is out of date.
+		if err.Code == 400 {
+			if retried {
+				return nil, newError(ErrConflict, "Update key \"%s\" failed: %s", key, err)
+			}
+			q.shaCache.remove(key)
+			_, getErr := q.Get(key) // Update last commit for the key
+			if getErr != nil {
+				return nil, fmt.Errorf("Get key \"%s\" failed: %w", key, getErr)
+			}
+			return q.set(key, value, true)
+		}
+		return nil, err
+	}
+	// The files API does not tell us the new commit, read it back.
+	record, getErr := q.Get(key)
+	if getErr != nil {
+		return nil, getErr
+	}
+	record.Content = ""
+	return record, nil
+}
+
+// SetIfMatch is a function to set a key only if it still matches expected
+func (q *GitlabQuerier) SetIfMatch(key string, value string, expected string) (*KeyRecord, error) {
+	current, err := q.getReq(key, q.option.Branch)
+	if err != nil && err.Code != 404 {
+		return nil, err
+	}
+	gpo := q.putOption("freedb update a key from golang client")
+	gpo.Content = base64.StdEncoding.EncodeToString([]byte(value))
+	gpo.Encoding = "base64"
+
+	method := "PUT"
+	if expected == "" {
+		if current != nil {
+			return nil, &ConflictError{Key: key}
+		}
+		method = "POST"
+		gpo.CommitMessage = "freedb create a key from golang client"
+	} else {
+		if current == nil {
+			return nil, &ConflictError{Key: key, Expected: expected}
+		}
+		if current.BlobID != expected && current.LastCommitID != expected {
+			// expected may be an older commit, the content must be the same as in that commit
+			past, err := q.getReq(key, expected)
+			if err != nil || past.BlobID != current.BlobID {
+				return nil, &ConflictError{Key: key, Expected: expected}
+			}
+		}
+		// gitlab rejects the update if the file changed after this commit
+		gpo.LastCommitID = current.LastCommitID
+	}
+	_, err = q.query(q.fileURL(key), method, gpo)
+	if err != nil {
+		if err.Code == 400 {
+			q.shaCache.remove(key)
+			return nil, &ConflictError{Key: key, Expected: expected}
+		}
+		return nil, err
+	}
+	record, getErr := q.Get(key)
+	if getErr != nil {
+		return nil, getErr
+	}
+	record.Content = ""
+	return record, nil
+}
+
+// Delete is a function to delete a key
+func (q *GitlabQuerier) Delete(key string) (*KeyRecord, error) {
+	return q.delete(key, false)
+}
+
+// delete removes a key, a conflict is retried once with the current sha of the key
+func (q *GitlabQuerier) delete(key string, retried bool) (*KeyRecord, error) {
+	gpo := q.putOption("freedb delete a key from golang client")
+	lastCommit, ok := q.shaCache.get(key)
+	if ok {
+		gpo.LastCommitID = lastCommit
+	}
+
+	_, err := q.query(q.fileURL(key), "DELETE", gpo)
+	if err != nil {
+		// 400: the file does not exist or has been changed since last_commit_id
+		if err.Code == 400 {
+			if retried {
+				return nil, newError(ErrConflict, "Update key \"%s\" failed: %s", key, err)
+			}
+			q.shaCache.remove(key)
+			getKr, getErr := q.Get(key) // Update last commit for the key
+			if getErr != nil {
+				return nil, fmt.Errorf("Get key \"%s\" failed: %w", key, getErr)
+			}
+			if getKr.Name == "" { // The key do not exist, can not delete it
+				return &KeyRecord{}, nil
+			}
+			return q.delete(key, true)
+		}
+		return nil, err
+	}
+	q.shaCache.remove(key)
+	return &KeyRecord{Name: key}, nil
+}
+
+// Batch is a function to write several keys in one commit with the commits API
+func (q *GitlabQuerier) Batch(ops []*BatchOp) (*KeyRecord, error) {
+	// Every action has to know whether the file exists
+	krl, err := q.listReq()
+	if err != nil && err.Code != 404 {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	if krl != nil {
+		for _, kr := range *krl {
+			existing[kr.Name] = true
+		}
+	}
+
+	gco := &gitlabCommitOption{
+		Branch:        q.option.Branch,
+		CommitMessage: fmt.Sprintf("freedb update %d keys from golang client", len(ops)),
+	}
+	if q.committer != nil {
+		gco.AuthorName = q.committer.Name
+		gco.AuthorEmail = q.committer.Email
+	}
+	for _, op := range ops {
+		action := &gitlabCommitAction{FilePath: q.option.DB + "/" + op.Key}
+		if op.Value == nil {
+			if !existing[op.Key] {
+				continue
+			}
+			action.Action = "delete"
+		} else {
+			action.Action = "create"
+			if existing[op.Key] {
+				action.Action = "update"
+			}
+			action.Content = base64.StdEncoding.EncodeToString([]byte(*op.Value))
+			action.Encoding = "base64"
+		}
+		gco.Actions = append(gco.Actions, action)
+	}
+	if len(gco.Actions) == 0 {
+		return &KeyRecord{}, nil
+	}
+
+	body, err := q.query(q.baseURL+"/repository/commits", "POST", gco)
+	if err != nil {
+		return nil, err
+	}
+	commit := &gitlabCommitInfo{}
+	if decodeErr := json.Unmarshal(*body, commit); decodeErr != nil {
+		return nil, &httpError{Message: decodeErr.Error()}
+	}
+	for _, action := range gco.Actions {
+		key := strings.TrimPrefix(action.FilePath, q.option.DB+"/")
+		if action.Action == "delete" {
+			q.shaCache.remove(key)
+		} else {
+			q.shaCache.set(key, commit.ID)
+		}
+	}
+	return &KeyRecord{Commit: commit.ID}, nil
+}
+
+// History is a function to list the commits which touched a key
+func (q *GitlabQuerier) History(key string) ([]*Revision, error) {
+	params := url.Values{}
+	params.Set("path", strings.TrimSuffix(q.option.DB+"/"+key, "/"))
+	params.Set("ref_name", q.option.Branch)
+	params.Set("per_page", "100")
+
+	history := []*Revision{}
+	for page := 1; ; page++ {
+		params.Set("page", fmt.Sprint(page))
+		body, err := q.query(q.baseURL+"/repository/commits?"+params.Encode(), "GET", nil)
+		if err != nil {
+			return nil, err
+		}
+		var commits []*gitlabCommit
+		decodeErr := json.Unmarshal(*body, &commits)
+		if decodeErr != nil {
+			return nil, &httpError{Message: decodeErr.Error()}
+		}
+		for _, commit := range commits {
+			history = append(history, commit.transfer())
+		}
+		if len(commits) < 100 {
+			return history, nil
+		}
+	}
+}
+
+// GetAt is a function to read a key at a commit, a tag or a branch
+func (q *GitlabQuerier) GetAt(key string, ref string) (*KeyRecord, error) {
+	record, err := q.getReq(key, ref)
+	if err != nil {
+		if err.Code == 404 {
+			return &KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	decodeBytes, _ := base64.StdEncoding.DecodeString(record.Content)
+	record.Content = string(decodeBytes)
+	return record.transfer(), nil
+}
+
+// KeysAt is a function to list all keys at a commit, a tag or a branch
+func (q *GitlabQuerier) KeysAt(ref string) (*[]*KeyRecord, error) {
+	record, err := q.listReqAt(ref)
+	if err != nil {
+		if err.Code == 404 {
+			return &[]*KeyRecord{}, nil
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// SetHost is a function to update the repository
+func (q *GitlabQuerier) SetHost(user, repo string) {
+	q.baseURL = gitlabBaseURL(q.option.APIURL, user, repo)
+	q.option.User = user
+	q.option.Repo = repo
+}
+
+// SetAPIURL is a function to update the API base URL
+func (q *GitlabQuerier) SetAPIURL(apiURL string) {
+	q.baseURL = gitlabBaseURL(apiURL, q.option.User, q.option.Repo)
+	q.option.APIURL = apiURL
+}
+
+// SetBranch is a function to update the branch
+func (q *GitlabQuerier) SetBranch(branch string) {
+	q.option.Branch = branch
+}
+
+// Use is a function to change database
+func (q *GitlabQuerier) Use(db string) {
+	q.option.DB = db
+}
+
+// SetToken is a function to update the token
+func (q *GitlabQuerier) SetToken(token string) {
+	q.option.Token = token
+}
+
+// Option is a function to get the current option
+func (q *GitlabQuerier) Option() *QuerierOption {
+	return q.option
+}
+
+// RateLimit is a function to get the rate limit reported by the last response
+func (q *GitlabQuerier) RateLimit() (*RateLimit, error) {
+	return q.rateLimit(func() *httpError {
+		_, err := q.query(q.baseURL, "GET", nil)
+		return err
+	})
+}
+
+// WithContext is a function to get a copy of the querier whose requests are cancelled when ctx is done
+func (q *GitlabQuerier) WithContext(ctx context.Context) Querier {
+	c := *q
+	c.ctx = ctx
+	return &c
+}
+
+func (q *GitlabQuerier) putOption(message string) *gitlabPutOption {
+	gpo := &gitlabPutOption{
+		Branch:        q.option.Branch,
+		CommitMessage: message,
+	}
+	if q.committer != nil {
+		gpo.AuthorName = q.committer.Name
+		gpo.AuthorEmail = q.committer.Email
+	}
+	return gpo
+}
+
+func (q *GitlabQuerier) fileURL(key string) string {
+	return fmt.Sprintf("%s/repository/files/%s", q.baseURL, url.PathEscape(q.option.DB+"/"+key))
+}
+
+func (q *GitlabQuerier) listReq() (*[]*KeyRecord, *httpError) {
+	return q.listReqAt(q.option.Branch)
+}
+
+// listReqAt lists the keys at a ref, which can be a branch, a tag or a commit
+func (q *GitlabQuerier) listReqAt(ref string) (*[]*KeyRecord, *httpError) {
+	params := url.Values{}
+	params.Set("path", q.option.DB)
+	params.Set("ref", ref)
+	params.Set("per_page", "100")
+
+	var krl []*KeyRecord
+	for page := 1; ; page++ {
+		params.Set("page", fmt.Sprint(page))
+		body, err := q.query(q.baseURL+"/repository/tree?"+params.Encode(), "GET", nil)
+		if err != nil {
+			return nil, err
+		}
+		var gtrl []*gitlabTreeRecord
+		decodeErr := json.Unmarshal(*body, &gtrl)
+		if decodeErr != nil {
+			return nil, &httpError{Message: decodeErr.Error()}
+		}
+		for _, gtr := range gtrl {
+			if gtr.Type != "blob" {
+				continue
+			}
+			krl = append(krl, &KeyRecord{Name: gtr.Name, Sha: gtr.ID, Path: gtr.Path})
+		}
+		if len(gtrl) < 100 {
+			break
+		}
+	}
+	return &krl, nil
+}
+
+// getReq reads a key at a ref, which can be a branch, a tag or a commit
+func (q *GitlabQuerier) getReq(key string, ref string) (*gitlabKeyRecord, *httpError) {
+	body, err := q.query(q.fileURL(key)+"?ref="+url.QueryEscape(ref), "GET", nil)
+	if err != nil {
+		return nil, err
+	}
+	kr := &gitlabKeyRecord{}
+	decodeErr := json.Unmarshal(*body, kr)
+	if decodeErr != nil {
+		return nil, &httpError{Message: decodeErr.Error()}
+	}
+	return kr, nil
+}
+
+func (q *GitlabQuerier) query(urlStr string, method string, data interface{}) (*[]byte, *httpError) {
+	req, err := q.newJSONRequest(method, urlStr, data)
+	if err != nil {
+		return nil, err
+	}
+	if q.option.Token != "" {
+		req.Header.Set("PRIVATE-TOKEN", q.option.Token)
+	}
+
+	resp, err := q.send(q.option, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 299 {
+		// gitlab reports validation errors as {"error": "..."}
+		var errBody struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		json.Unmarshal(respBody, &errBody)
+		if errBody.Message == "" {
+			errBody.Message = errBody.Error
+		}
+		return nil, statusError(resp, errBody.Message)
+	}
+	return &respBody, nil
+}
+
+func (gkr *gitlabKeyRecord) transfer() *KeyRecord {
+	return &KeyRecord{
+		Content: gkr.Content,
+		Name:    gkr.FileName,
+		Size:    gkr.Size,
+		Sha:     gkr.BlobID,
+		Commit:  gkr.LastCommitID,
+		Path:    gkr.FilePath,
+	}
+}
+
+func (gc *gitlabCommit) transfer() *Revision {
+	return &Revision{
+		Commit:  gc.ID,
+		Author:  gc.AuthorName,
+		Email:   gc.AuthorEmail,
+		Date:    gc.AuthoredDate,
+		Message: gc.Message,
+	}
+}
@@ -0,0 +1,110 @@
+package kv
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newGitlabTestServer fakes the part of the gitlab files API used by GitlabQuerier
+func newGitlabTestServer(t *testing.T) *httptest.Server {
+	files := make(map[string]string)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "token" {
+			w.WriteHeader(401)
+			return
+		}
+		path := r.URL.EscapedPath()
+		if strings.HasSuffix(path, "/repository/tree") {
+			var list []*gitlabTreeRecord
+			for name := range files {
+				list = append(list, &gitlabTreeRecord{Name: strings.TrimPrefix(name, "golang/"), Type: "blob"})
+			}
+			json.NewEncoder(w).Encode(list)
+			return
+		}
+		i := strings.Index(path, "/repository/files/")
+		if i == -1 {
+			w.WriteHeader(404)
+			return
+		}
+		name, _ := url.PathUnescape(path[i+len("/repository/files/"):])
+		content, exist := files[name]
+		switch r.Method {
+		case "GET":
+			if !exist {
+				w.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(w).Encode(&gitlabKeyRecord{
+				FileName:     name[strings.LastIndex(name, "/")+1:],
+				Content:      base64.StdEncoding.EncodeToString([]byte(content)),
+				LastCommitID: "commit",
+			})
+		case "POST", "PUT", "DELETE":
+			if (r.Method == "POST") == exist {
+				w.WriteHeader(400)
+				w.Write([]byte(`{"message": "A file with this name already exists"}`))
+				return
+			}
+			gpo := &gitlabPutOption{}
+			json.NewDecoder(r.Body).Decode(gpo)
+			if gpo.Branch != "master" {
+				t.Errorf("expect branch master, got %s", gpo.Branch)
+			}
+			if r.Method == "DELETE" {
+				delete(files, name)
+			} else {
+				b, _ := base64.StdEncoding.DecodeString(gpo.Content)
+				files[name] = string(b)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"file_path": name, "branch": gpo.Branch})
+		}
+	}))
+}
+
+func TestGitlabQuerier(t *testing.T) {
+	server := newGitlabTestServer(t)
+	defer server.Close()
+
+	kv, err := NewKV("git@gitlab.com:Gcaufy-Test/test-database.git", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.UseCache = false
+	kv.Use("golang")
+	kv.SetAPIURL(server.URL)
+
+	if _, err = kv.Set("key-exist", "123"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := kv.Append("key-exist", "456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Content != "123456" {
+		t.Errorf("expect 123456, got %s", record.Content)
+	}
+	// A second querier does not know the key exists, Set should recover from 400
+	other := NewGitlabQuerier(&QuerierOption{APIURL: server.URL, DB: "golang", Branch: "master", Token: "token"})
+	if _, err = other.Set("key-exist", "789"); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ = kv.Get("key-exist"); record.Content != "789" {
+		t.Errorf("expect 789, got %s", record.Content)
+	}
+	if _, err = kv.Delete("key-exist"); err != nil {
+		t.Fatal(err)
+	}
+	list, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*list) != 0 {
+		t.Errorf("expect no keys, got %d", len(*list))
+	}
+}
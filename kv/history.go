@@ -0,0 +1,135 @@
+package kv
+
+import (
+	"fmt"
+	"time"
+)
+
+// Revision is a commit which touched a key
+type Revision struct {
+	Commit  string    `json:"commit"`
+	Author  string    `json:"author,omitempty"`
+	Email   string    `json:"email,omitempty"`
+	Date    time.Time `json:"date"`
+	Message string    `json:"message,omitempty"`
+}
+
+// HistoryQuerier is implemented by queriers which can read past versions of a key
+type HistoryQuerier interface {
+	// History lists the commits of the branch which touched the key, newest first.
+	// Deleting a key is part of its history too. An empty key lists the commits
+	// which touched the database.
+	History(key string) ([]*Revision, error)
+	// GetAt reads the key at ref, which is a commit sha, a tag or a branch.
+	// A key missing at ref gives an empty record.
+	GetAt(key string, ref string) (*KeyRecord, error)
+	// KeysAt lists the keys at ref, with the Sha of every key when the backend knows it
+	KeysAt(ref string) (*[]*KeyRecord, error)
+}
+
+// timeLayouts are the formats GetAt accepts as a point in time, the ones
+// without a zone are in local time
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+func parseTime(rev string) (time.Time, bool) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, rev, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (kv *KV) historyQuerier() (HistoryQuerier, error) {
+	hq, ok := kv.querier.(HistoryQuerier)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support history", kv.querier)
+	}
+	return hq, nil
+}
+
+// History is the function to list the commits which touched a key, newest first
+func (kv *KV) History(key string) ([]*Revision, error) {
+	hq, err := kv.historyQuerier()
+	if err != nil {
+		return nil, err
+	}
+	names, err := kv.storedNames(key, false)
+	if err != nil {
+		return nil, err
+	}
+	var history []*Revision
+	for _, name := range names {
+		history, err = hq.History(name)
+		if err != nil || len(history) > 0 {
+			break
+		}
+	}
+	return history, err
+}
+
+// GetAt is the function to read a key as it was at rev, which is a commit sha,
+// a tag, or a point in time like "2019-06-01" or "2019-06-01T12:00:00+08:00".
+// A key missing at rev gives an empty record. The result is never cached.
+func (kv *KV) GetAt(key string, rev string) (*KeyRecord, error) {
+	hq, err := kv.historyQuerier()
+	if err != nil {
+		return nil, err
+	}
+	names, err := kv.storedNames(key, false)
+	if err != nil {
+		return nil, err
+	}
+	record := &KeyRecord{}
+	var name string
+	for _, name = range names {
+		record, err = getAt(hq, name, rev)
+		if err != nil {
+			return nil, err
+		}
+		if record.Name != "" {
+			break
+		}
+	}
+	record.Content, err = kv.decryptValue(key, name, record.Content)
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// getAt reads the stored name at rev, resolving a point in time with the history
+func getAt(hq HistoryQuerier, key string, rev string) (*KeyRecord, error) {
+	if t, ok := parseTime(rev); ok {
+		var err error
+		if rev, err = commitAt(hq, key, t); err != nil {
+			return nil, err
+		}
+		if rev == "" {
+			return &KeyRecord{}, nil
+		}
+	}
+	return hq.GetAt(key, rev)
+}
+
+// commitAt returns the last commit before t which touched the key, or the
+// database with an empty key, it is empty if there is none. The state at a
+// point in time is the one of that commit.
+func commitAt(hq HistoryQuerier, key string, t time.Time) (string, error) {
+	history, err := hq.History(key)
+	if err != nil {
+		return "", err
+	}
+	for _, revision := range history {
+		if !revision.Date.After(t) {
+			return revision.Commit, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,117 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// httpError is the error of a request to the API of a git host
+type httpError struct {
+	Message string `json:"message"`
+	Code    int    `json:"code"`
+	// unreachable is set when the request did not reach the host
+	unreachable bool
+	// err is the sentinel error matched instead of the one of the status
+	err error
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.Code, e.Message)
+}
+
+// Unreachable reports whether the request failed before reaching the host
+func (e *httpError) Unreachable() bool {
+	return e.unreachable
+}
+
+// StatusCode is the http status of the response, 0 if there was none
+func (e *httpError) StatusCode() int {
+	return e.Code
+}
+
+// Is reports whether the status matches a sentinel error, e.g. ErrNotFound
+func (e *httpError) Is(target error) bool {
+	return e.err == nil && statusIs(e.Code, target)
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// statusError returns the error of a response which is not a success,
+// message is the one the host sent, the status is used without one
+func statusError(resp *http.Response, message string) *httpError {
+	switch resp.StatusCode {
+	case 401:
+		return &httpError{Code: 401, Message: "Invalid token"}
+	case 404:
+		return &httpError{Code: 404, Message: "Invalid repository or invalid key"}
+	}
+	if message == "" {
+		message = resp.Status
+	}
+	err := &httpError{Code: resp.StatusCode, Message: message}
+	if rateLimited(resp) {
+		err.err = ErrRateLimited
+	}
+	return err
+}
+
+// httpClient sends the requests of the queriers of git hosts
+type httpClient struct {
+	limits *rateLimits
+	// ctx cancels the requests of a copy made by WithContext, nil otherwise
+	ctx context.Context
+}
+
+// newRequest creates a request bound to the context of the client, a body
+// is sent with contentType
+func (c *httpClient) newRequest(method string, urlStr string, body io.Reader, contentType string) (*http.Request, *httpError) {
+	req, err := http.NewRequest(method, urlStr, body)
+	if err != nil {
+		return nil, &httpError{Message: err.Error()}
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.ctx != nil {
+		req = req.WithContext(c.ctx)
+	}
+	req.Header.Set("User-Agent", "freedb")
+	return req, nil
+}
+
+// newJSONRequest creates a request sending data as JSON, without a body if data is nil
+func (c *httpClient) newJSONRequest(method string, urlStr string, data interface{}) (*http.Request, *httpError) {
+	if data == nil {
+		return c.newRequest(method, urlStr, nil, "")
+	}
+	body := new(bytes.Buffer)
+	json.NewEncoder(body).Encode(data)
+	return c.newRequest(method, urlStr, body, "application/json")
+}
+
+// send sends a request with the retry policy of option, and keeps the rate limit of the response
+func (c *httpClient) send(option *QuerierOption, req *http.Request) (*http.Response, *httpError) {
+	resp, err := option.send(req, c.limits)
+	if err != nil {
+		return nil, &httpError{Message: err.Error(), unreachable: !canceled(c.ctx)}
+	}
+	return resp, nil
+}
+
+// rateLimit returns the last known rate limit, probe sends a request when none is known yet
+func (c *httpClient) rateLimit(probe func() *httpError) (*RateLimit, error) {
+	if rl, ok := c.limits.get(); ok {
+		return rl, nil
+	}
+	if err := probe(); err != nil {
+		return nil, err
+	}
+	rl, _ := c.limits.get()
+	return rl, nil
+}
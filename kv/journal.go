@@ -0,0 +1,486 @@
+package kv
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// unreachableError is implemented by the errors of queriers which tell a
+// request which never reached the host from an error of the host
+type unreachableError interface {
+	Unreachable() bool
+}
+
+// isUnreachable reports whether err, or an error it wraps, never reached the host
+func isUnreachable(err error) bool {
+	var ue unreachableError
+	return errors.As(err, &ue) && ue.Unreachable()
+}
+
+// journal keeps the writes which could not reach the host, one file per
+// database. Names and values are kept as stored, so they stay encrypted when
+// a secret or key providers are set.
+type journal struct {
+	dir string
+	// mu guards the journal files, Sync holds it while replaying
+	mu sync.Mutex
+}
+
+type journalEntry struct {
+	// Op is "set", "append" or "delete", the value of an append is added to
+	// the content the key has when it is replayed
+	Op    string `json:"op"`
+	Name  string `json:"name"`
+	Value string `json:"value,omitempty"`
+	// Base is the version the key had when it was written, see keyVersion
+	Base string `json:"base,omitempty"`
+	// Missing is set if the key did not exist when it was written. Without
+	// Base or Missing the key was never read, which skips the conflict detection.
+	Missing bool      `json:"missing,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// journalBase is the state a journaled write expects a name to have on the host
+type journalBase struct {
+	missing bool
+	version string
+}
+
+// base returns what the entry expects, nil if it was written blindly
+func (e *journalEntry) base() *journalBase {
+	if !e.Missing && e.Base == "" {
+		return nil
+	}
+	return &journalBase{missing: e.Missing, version: e.Base}
+}
+
+// matches reports whether a record read from the host is in the expected state
+func (b *journalBase) matches(record *KeyRecord) bool {
+	if b.missing {
+		return record.Name == ""
+	}
+	return record.Name != "" && keyVersion(record) == b.version
+}
+
+// recordBase returns the state of a record, nil if its version is unknown
+func recordBase(record *KeyRecord) *journalBase {
+	if record.Name == "" {
+		return &journalBase{missing: true}
+	}
+	if version := keyVersion(record); version != "" {
+		return &journalBase{version: version}
+	}
+	return nil
+}
+
+// writtenBase returns the state of a record just written, nil if its version is unknown
+func writtenBase(record *KeyRecord) *journalBase {
+	if version := keyVersion(record); version != "" {
+		return &journalBase{version: version}
+	}
+	return nil
+}
+
+// keyVersion returns the sha of a record, or the commit for backends which
+// report no sha
+func keyVersion(record *KeyRecord) string {
+	if record.Sha != "" {
+		return record.Sha
+	}
+	return record.Commit
+}
+
+// SyncConflict is a journaled write which was not replayed, because the key
+// changed on the host since it was written
+type SyncConflict struct {
+	Key string `json:"key"`
+	// Op is "set", "append" or "delete"
+	Op string `json:"op"`
+	// Value is the value which was not written or appended
+	Value string `json:"value,omitempty"`
+	// Expected is the version the key had when it was written, empty if it was missing
+	Expected string `json:"expected"`
+	// Actual is the version of the key on the host, empty if it is missing
+	Actual string `json:"actual"`
+}
+
+// SyncResult is the result of Sync
+type SyncResult struct {
+	// Applied are the keys of the replayed writes, in order
+	Applied   []string        `json:"applied"`
+	Conflicts []*SyncConflict `json:"conflicts"`
+}
+
+func (j *journal) file(location string) string {
+	return filepath.Join(j.dir, hashName(location)+".journal")
+}
+
+func (j *journal) read(location string) ([]*journalEntry, error) {
+	content, err := ioutil.ReadFile(j.file(location))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*journalEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (j *journal) write(location string, entries []*journalEntry) error {
+	path := j.file(location)
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, _ := json.MarshalIndent(entries, "", "  ")
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pending returns the journaled writes of a stored name, in order
+func (j *journal) pending(location string, name string) []*journalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	entries, err := j.read(location)
+	if err != nil {
+		return nil
+	}
+	var pending []*journalEntry
+	for _, entry := range entries {
+		if entry.Name == name {
+			pending = append(pending, entry)
+		}
+	}
+	return pending
+}
+
+func lastEntry(entries []*journalEntry, name string) *journalEntry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Name == name {
+			return entries[i]
+		}
+	}
+	return nil
+}
+
+// SetJournal is a function to keep Set, Delete and Append writes which can not
+// reach the host in a journal in dir, or in the "journal" folder of
+// DefaultDiskCacheDir if dir is empty. Journaled writes are returned with
+// Pending set, read back by Get, and replayed by Sync. An Append to a key which
+// can not be read is added to the content the key has when Sync replays it.
+func (kv *KV) SetJournal(dir string) error {
+	if dir == "" {
+		var err error
+		if dir, err = DefaultDiskCacheDir(); err != nil {
+			return err
+		}
+		dir = filepath.Join(dir, "journal")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	kv.journal = &journal{dir: dir}
+	return nil
+}
+
+// DisableJournal is a function to stop journaling writes, the journal is kept
+func (kv *KV) DisableJournal() {
+	kv.journal = nil
+}
+
+// journalWrite keeps a write of a stored name which failed with err, it
+// returns err unless the write is journaled
+func (kv *KV) journalWrite(key string, op string, name string, value string, err error) (*KeyRecord, error) {
+	if kv.journal == nil || !isUnreachable(err) {
+		return nil, err
+	}
+	loc := kv.location()
+	kv.journal.mu.Lock()
+	defer kv.journal.mu.Unlock()
+	entries, readErr := kv.journal.read(loc)
+	if readErr != nil {
+		return nil, readErr
+	}
+	entry := &journalEntry{Op: op, Name: name, Value: value, Time: time.Now()}
+	// An append does not depend on the content it is added to
+	if op != "append" && lastEntry(entries, name) == nil {
+		if base := kv.knownBase(key, name); base != nil {
+			entry.Base, entry.Missing = base.version, base.missing
+		}
+	}
+	if writeErr := kv.journal.write(loc, append(entries, entry)); writeErr != nil {
+		return nil, writeErr
+	}
+	kv.forget(name)
+	switch op {
+	case "delete":
+		return &KeyRecord{Pending: true}, nil
+	case "append":
+		return &KeyRecord{Name: name, Pending: true}, nil
+	}
+	return &KeyRecord{Name: name, Size: len(value), Pending: true}, nil
+}
+
+// knownBase returns the state of a stored name as last read, nil if unknown
+func (kv *KV) knownBase(key string, name string) *journalBase {
+	if record, ok := kv.cache.get(kv.cacheKey(key)); ok && kv.UseCache && (record.Name == name || record.Name == "") {
+		return recordBase(record)
+	}
+	if kv.disk != nil {
+		if record, _, ok := kv.disk.get(kv.location(), name); ok {
+			return recordBase(record)
+		}
+	}
+	return nil
+}
+
+// journalAppend keeps an append to a key whose content could not be read
+// because of err, it returns err unless the append is journaled
+func (kv *KV) journalAppend(key string, value string, err error) (*KeyRecord, error) {
+	if kv.journal == nil || !isUnreachable(err) {
+		return nil, err
+	}
+	name, encErr := kv.encryptKey(key)
+	if encErr != nil {
+		return nil, encErr
+	}
+	encrypted, encErr := kv.encryptValue(name, value)
+	if encErr != nil {
+		return nil, encErr
+	}
+	if kv.UseCache {
+		kv.cache.remove(kv.cacheKey(key))
+	}
+	return kv.journalWrite(key, "append", name, encrypted, err)
+}
+
+// pendingRecord returns the journaled write of a stored name, if any. The
+// values of the last appends are returned apart, with a nil record when the
+// content they are added to was never journaled.
+func (kv *KV) pendingRecord(name string) (*KeyRecord, []string, bool) {
+	if kv.journal == nil {
+		return nil, nil, false
+	}
+	entries := kv.journal.pending(kv.location(), name)
+	if len(entries) == 0 {
+		return nil, nil, false
+	}
+	var appended []string
+	i := len(entries) - 1
+	for ; i >= 0 && entries[i].Op == "append"; i-- {
+		appended = append([]string{entries[i].Value}, appended...)
+	}
+	if i < 0 {
+		return nil, appended, true
+	}
+	if entries[i].Op == "delete" {
+		return &KeyRecord{Pending: true}, appended, true
+	}
+	value := entries[i].Value
+	return &KeyRecord{Name: name, Content: value, Size: len(value), Pending: true}, appended, true
+}
+
+// appendPending adds the values of journaled appends to a stored record
+func (kv *KV) appendPending(name string, record *KeyRecord, appended []string) (*KeyRecord, error) {
+	var ring *keyring
+	if kv.encrypted() {
+		var err error
+		if ring, err = kv.cipherKeys(false); err != nil {
+			return nil, err
+		}
+	}
+	content, err := kv.joinStored(name, record.Content, appended, ring)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{Name: name, Content: content, Size: len(content), Pending: true}, nil
+}
+
+// joinStored concatenates the values stored under name, encrypted values are
+// opened with ring and the result is sealed again with its data key
+func (kv *KV) joinStored(name string, content string, appended []string, ring *keyring) (string, error) {
+	if !kv.encrypted() {
+		return content + strings.Join(appended, ""), nil
+	}
+	var plain string
+	for _, value := range append([]string{content}, appended...) {
+		if value == "" {
+			continue
+		}
+		opened, err := ring.open(name, value)
+		if err != nil {
+			return "", err
+		}
+		plain += opened
+	}
+	return ring.seal(name, plain)
+}
+
+// Sync is the function to replay the journaled writes of the current database
+// in order. A write is not replayed if the key changed on the host since it was
+// written, it is reported as a conflict and dropped from the journal. Sync
+// stops at the first write which fails, it and the following ones are kept.
+// Writes made during Sync wait for it if they have to be journaled.
+func (kv *KV) Sync() (*SyncResult, error) {
+	result := &SyncResult{Applied: []string{}, Conflicts: []*SyncConflict{}}
+	if kv.journal == nil {
+		return result, nil
+	}
+	loc := kv.location()
+	// The keys are needed before locking, reading the metadata reads the journal
+	var ring *keyring
+	if kv.encrypted() {
+		var err error
+		if ring, err = kv.cipherKeys(false); err != nil {
+			return nil, err
+		}
+	}
+	kv.journal.mu.Lock()
+	defer kv.journal.mu.Unlock()
+	entries, err := kv.journal.read(loc)
+	if err != nil || len(entries) == 0 {
+		return result, err
+	}
+
+	// The state of the names replayed so far, and the names which conflicted
+	replayed := make(map[string]*journalBase)
+	conflicted := make(map[string]bool)
+	for i, entry := range entries {
+		key := entry.Name
+		if kv.encrypted() {
+			key, _, _ = kv.decryptName(entry.Name, ring)
+		}
+		expected := entry.base()
+		if base, ok := replayed[entry.Name]; ok {
+			expected = base
+		}
+
+		base, actual, err := kv.replay(entry, key, ring, expected, conflicted[entry.Name])
+		if _, ok := err.(*ConflictError); ok {
+			conflicted[entry.Name] = true
+			conflict := &SyncConflict{Key: key, Op: entry.Op, Actual: actual}
+			if expected != nil {
+				conflict.Expected = expected.version
+			}
+			if entry.Op != "delete" {
+				conflict.Value = entry.Value
+				if kv.encrypted() {
+					conflict.Value, _ = ring.open(entry.Name, entry.Value)
+				}
+			}
+			result.Conflicts = append(result.Conflicts, conflict)
+		} else if err != nil {
+			if writeErr := kv.journal.write(loc, entries[i:]); writeErr != nil {
+				return nil, writeErr
+			}
+			return result, err
+		} else {
+			replayed[entry.Name] = base
+			result.Applied = append(result.Applied, key)
+		}
+		kv.forget(entry.Name)
+		if kv.UseCache {
+			kv.cache.remove(kv.cacheKey(key))
+		}
+	}
+	if err := kv.journal.write(loc, nil); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// replay writes a journaled entry if the name is still in the expected state.
+// It returns the new state of the name, or its actual version with a *ConflictError.
+func (kv *KV) replay(entry *journalEntry, key string, ring *keyring, expected *journalBase, conflicted bool) (*journalBase, string, error) {
+	var current *KeyRecord
+	if expected != nil || conflicted {
+		record, err := kv.querier.Get(entry.Name)
+		if err != nil {
+			return nil, "", err
+		}
+		current = record
+		// A key written after a conflict keeps conflicting
+		if conflicted || !expected.matches(record) {
+			return nil, keyVersion(record), &ConflictError{Key: entry.Name, Expected: keyVersion(record)}
+		}
+	}
+
+	if entry.Op == "delete" {
+		if current == nil || current.Name != "" {
+			if _, err := kv.querier.Delete(entry.Name); err != nil {
+				return nil, "", err
+			}
+		}
+		return &journalBase{missing: true}, "", nil
+	}
+	value := entry.Value
+	if entry.Op == "append" {
+		var err error
+		if value, expected, err = kv.appendedValue(entry, key, ring); err != nil {
+			return nil, "", err
+		}
+	}
+	if cq, ok := kv.querier.(ConditionalQuerier); ok && expected != nil {
+		record, err := cq.SetIfMatch(entry.Name, value, expected.version)
+		if _, ok := err.(*ConflictError); ok {
+			current, getErr := kv.querier.Get(entry.Name)
+			if getErr != nil {
+				return nil, "", getErr
+			}
+			return nil, keyVersion(current), err
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return writtenBase(record), "", nil
+	}
+	record, err := kv.querier.Set(entry.Name, value)
+	if err != nil {
+		return nil, "", err
+	}
+	return writtenBase(record), "", nil
+}
+
+// appendedValue returns the content of a key with the value of a journaled
+// append added, and the state the name must still have to write it
+func (kv *KV) appendedValue(entry *journalEntry, key string, ring *keyring) (string, *journalBase, error) {
+	names := []string{entry.Name}
+	if kv.encrypted() {
+		names = ring.names(key)
+	}
+	// The key may still be stored in an older format
+	current := &KeyRecord{}
+	for _, name := range names {
+		record, err := kv.querier.Get(name)
+		if err != nil {
+			return "", nil, err
+		}
+		if record.Name != "" {
+			current = record
+			break
+		}
+	}
+	value, err := kv.joinStored(entry.Name, current.Content, []string{entry.Value}, ring)
+	if err != nil {
+		return "", nil, err
+	}
+	if current.Name != entry.Name {
+		return value, &journalBase{missing: true}, nil
+	}
+	return value, recordBase(current), nil
+}
@@ -0,0 +1,172 @@
+package kv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMemoryJournal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "freedb")
+	defer os.RemoveAll(dir)
+	store := NewMemoryStore()
+	querier := &offlineQuerier{MemoryQuerier: NewMemoryQuerier(store, nil)}
+	kv := NewKVWithQuerier(querier)
+	kv.SetSecret("secret")
+	if err := kv.SetJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.SetSecret("secret")
+	for _, key := range []string{"kept", "changed", "removed"} {
+		kv.Set(key, "1")
+		kv.Get(key)
+	}
+
+	querier.offline = true
+	if record, err := kv.Set("new", "2"); err != nil || !record.Pending {
+		t.Fatalf("expect a pending write, got %v %v", record, err)
+	}
+	kv.Append("kept", "2")
+	kv.Set("changed", "2")
+	kv.Delete("removed")
+	// Journaled writes are read back
+	kv.UseCache = false
+	if record, err := kv.Get("kept"); err != nil || record.Content != "12" {
+		t.Errorf("expect 12, got %v %v", record, err)
+	}
+	if record, err := kv.Get("removed"); err != nil || record.Name != "" {
+		t.Errorf("expect removed to be deleted, got %v %v", record, err)
+	}
+	// The journal fails while offline
+	if _, err := kv.Sync(); err == nil {
+		t.Error("expect sync to fail offline")
+	}
+
+	other.Set("changed", "3")
+	querier.offline = false
+	result, err := kv.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Key != "changed" || result.Conflicts[0].Value != "2" {
+		t.Errorf("expect changed to conflict, got %+v", result.Conflicts)
+	}
+	for key, expect := range map[string]string{"new": "2", "kept": "12", "changed": "3", "removed": ""} {
+		if record, _ := other.Get(key); record.Content != expect {
+			t.Errorf("expect %s to be %q, got %q", key, expect, record.Content)
+		}
+	}
+	if result, _ := kv.Sync(); len(result.Applied) != 0 {
+		t.Errorf("expect an empty journal, got %v", result.Applied)
+	}
+}
+
+func TestMemoryJournalAppend(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		dir, _ := ioutil.TempDir("", "freedb")
+		defer os.RemoveAll(dir)
+		store := NewMemoryStore()
+		querier := &offlineQuerier{MemoryQuerier: NewMemoryQuerier(store, nil)}
+		kv := NewKVWithQuerier(querier)
+		kv.SetSecret(secret)
+		if err := kv.SetJournal(dir); err != nil {
+			t.Fatal(err)
+		}
+		other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+		other.SetSecret(secret)
+		other.UseCache = false
+		other.Set("log", "a")
+		kv.Get("other")
+
+		// The content of log was never read, the values are appended by Sync
+		querier.offline = true
+		for _, value := range []string{"b", "c"} {
+			if record, err := kv.Append("log", value); err != nil || !record.Pending {
+				t.Fatalf("%q: expect a pending append, got %v %v", secret, record, err)
+			}
+		}
+		other.Append("log", "x")
+		querier.offline = false
+		if record, err := kv.Get("log"); err != nil || record.Content != "axbc" || !record.Pending {
+			t.Errorf("%q: expect a pending axbc, got %v %v", secret, record, err)
+		}
+		result, err := kv.Sync()
+		if err != nil || len(result.Applied) != 2 || len(result.Conflicts) != 0 {
+			t.Fatalf("%q: expect 2 appends to be replayed, got %+v %v", secret, result, err)
+		}
+		if record, _ := other.Get("log"); record.Content != "axbc" {
+			t.Errorf("%q: expect axbc, got %q", secret, record.Content)
+		}
+	}
+}
+
+func TestIsUnreachable(t *testing.T) {
+	if !isUnreachable(fmt.Errorf("Get key \"key\" failed: %w", &unreachable{})) {
+		t.Error("expect a wrapped unreachable error to be unreachable")
+	}
+	if isUnreachable(newError(ErrConflict, "Update key \"key\" failed")) {
+		t.Error("expect a conflict to be reachable")
+	}
+}
+
+// noShaQuerier reports no sha and can not write conditionally, like bitbucket
+type noShaQuerier struct {
+	Querier
+}
+
+func (q *noShaQuerier) Get(key string) (*KeyRecord, error) {
+	record, err := q.Querier.Get(key)
+	if record != nil {
+		record.Sha = ""
+	}
+	return record, err
+}
+
+func (q *noShaQuerier) Set(key string, value string) (*KeyRecord, error) {
+	record, err := q.Querier.Set(key, value)
+	if record != nil {
+		record.Sha = ""
+	}
+	return record, err
+}
+
+func TestMemoryJournalWithoutSha(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "freedb")
+	defer os.RemoveAll(dir)
+	store := NewMemoryStore()
+	querier := &offlineQuerier{MemoryQuerier: NewMemoryQuerier(store, nil)}
+	kv := NewKVWithQuerier(&noShaQuerier{querier})
+	if err := kv.SetJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	for _, key := range []string{"removed", "changed"} {
+		kv.Set(key, "1")
+		kv.Get(key)
+	}
+
+	querier.offline = true
+	kv.Delete("removed")
+	kv.Set("changed", "2")
+	querier.offline = false
+	other.Set("changed", "3")
+	result, err := kv.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 1 || result.Applied[0] != "removed" {
+		t.Errorf("expect removed to be applied, got %v", result.Applied)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].Key != "changed" {
+		t.Errorf("expect changed to conflict, got %+v", result.Conflicts)
+	}
+	if record, _ := other.Get("removed"); record.Name != "" {
+		t.Errorf("expect removed to be deleted on the host, got %v", record)
+	}
+	if record, _ := other.Get("changed"); record.Content != "3" {
+		t.Errorf("expect changed to be kept, got %v", record)
+	}
+}
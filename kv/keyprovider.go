@@ -0,0 +1,148 @@
+package kv
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// KeyProvider wraps the random data key of a database for its recipients.
+// The wrapped keys of all providers are stored together in the metadata.
+type KeyProvider interface {
+	// Wrap returns the data key wrapped for every recipient, by recipient id
+	Wrap(dataKey []byte) (map[string]string, error)
+	// Unwrap recovers the data key from the wrapped keys of all recipients
+	Unwrap(wrapped map[string]string) ([]byte, error)
+}
+
+// passphraseProvider wraps the data key with a key derived from a passphrase
+type passphraseProvider struct {
+	id         string
+	passphrase func() (string, error)
+}
+
+// NewKeyfileProvider creates a KeyProvider wrapping with the content of a local
+// file. The recipient id is the file name, so the file can be moved around, and
+// the keyfiles of the recipients of a database must have different names.
+func NewKeyfileProvider(path string) KeyProvider {
+	return &passphraseProvider{
+		id: "keyfile:" + filepath.Base(path),
+		passphrase: func() (string, error) {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return "", err
+			}
+			passphrase := strings.TrimSpace(string(content))
+			if passphrase == "" {
+				return "", fmt.Errorf("Keyfile \"%s\" is empty", path)
+			}
+			return passphrase, nil
+		},
+	}
+}
+
+// NewEnvKeyProvider creates a KeyProvider wrapping with the value of an environment variable
+func NewEnvKeyProvider(name string) KeyProvider {
+	return &passphraseProvider{
+		id: "env:" + name,
+		passphrase: func() (string, error) {
+			passphrase := os.Getenv(name)
+			if passphrase == "" {
+				return "", fmt.Errorf("Environment variable \"%s\" is not set", name)
+			}
+			return passphrase, nil
+		},
+	}
+}
+
+// Wrap seals the data key with AES-GCM, the output is base64(salt | sealed key)
+func (p *passphraseProvider) Wrap(dataKey []byte) (map[string]string, error) {
+	passphrase, err := p.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 32768, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := encrypt(string(dataKey), string(key), "")
+	if err != nil {
+		return nil, err
+	}
+	wrapped := base64.StdEncoding.EncodeToString(append(salt, sealed...))
+	return map[string]string{p.id: wrapped}, nil
+}
+
+// Unwrap opens the data key wrapped for the recipient id of the provider
+func (p *passphraseProvider) Unwrap(wrapped map[string]string) ([]byte, error) {
+	stanza, ok := wrapped[p.id]
+	if !ok {
+		return nil, fmt.Errorf("The data key is not wrapped for \"%s\"", p.id)
+	}
+	bs, err := base64.StdEncoding.DecodeString(stanza)
+	if err != nil || len(bs) < 16 {
+		return nil, fmt.Errorf("Invalid wrapped key for \"%s\"", p.id)
+	}
+	passphrase, err := p.passphrase()
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), bs[:16], 32768, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := decrypt(string(bs[16:]), string(key), "")
+	if err != nil {
+		return nil, fmt.Errorf("Unwrap the data key for \"%s\" failed: %s", p.id, err)
+	}
+	return []byte(dataKey), nil
+}
+
+// RewrapDataKey is the function to wrap the data key of the current database
+// for the key providers set with SetKeyProvider, replacing the recipients it
+// was wrapped for. One of the providers must be able to unwrap it. The values
+// keep their encryption, a removed recipient which kept the data key can
+// still decrypt them.
+func (kv *KV) RewrapDataKey() (*KeyRecord, error) {
+	if len(kv.providers) == 0 {
+		return nil, fmt.Errorf("No key provider is set")
+	}
+	record, err := kv.querier.Get(metadataFile)
+	if err != nil {
+		return nil, err
+	}
+	m := &metadata{}
+	if record.Name != "" {
+		if err := json.Unmarshal([]byte(record.Content), m); err != nil {
+			return nil, fmt.Errorf("Invalid %s: %s", metadataFile, err)
+		}
+	}
+	if m.KDF != "envelope" {
+		return nil, fmt.Errorf("The database is not encrypted with key providers")
+	}
+	dataKey, err := m.unwrap(kv.providers)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.wrap(dataKey, kv.providers); err != nil {
+		return nil, err
+	}
+	content, _ := json.MarshalIndent(m, "", "  ")
+	defer kv.forget(metadataFile)
+	if cq, ok := kv.querier.(ConditionalQuerier); ok {
+		return cq.SetIfMatch(metadataFile, string(content), record.Sha)
+	}
+	return kv.querier.Set(metadataFile, string(content))
+}
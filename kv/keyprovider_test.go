@@ -0,0 +1,155 @@
+package kv
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBech32(t *testing.T) {
+	// Vector of BIP 173
+	if hrp, data, err := bech32Decode("A12UEL5L"); err != nil || hrp != "a" || len(data) != 0 {
+		t.Errorf("expect a valid empty string, got %s %v %v", hrp, data, err)
+	}
+	if _, _, err := bech32Decode("a12uel5m"); err == nil {
+		t.Error("expect an invalid checksum")
+	}
+	// Test keys of age
+	var identity [32]byte
+	for i := range identity {
+		identity[i] = 0x42
+	}
+	s, _ := bech32Encode(ageIdentityPrefix, identity[:])
+	if strings.ToUpper(s) != "AGE-SECRET-KEY-1GFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPYYSJZGFPQ4EGAEX" {
+		t.Errorf("unexpected identity %s", s)
+	}
+	if recipient, _ := ageRecipient(identity); recipient != "age1zvkyg2lqzraa2lnjvqej32nkuu0ues2s82hzrye869xeexvn73equnujwj" {
+		t.Errorf("unexpected recipient %s", recipient)
+	}
+
+	key := make([]byte, 32)
+	rand.Read(key)
+	s, _ = bech32Encode(ageIdentityPrefix, key)
+	hrp, data, err := bech32Decode(strings.ToUpper(s))
+	if err != nil || hrp != "age-secret-key-" || string(data) != string(key) {
+		t.Errorf("expect the key back, got %s %v %v", hrp, data, err)
+	}
+}
+
+func TestMemoryKeyProviders(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "freedb")
+	defer os.RemoveAll(dir)
+	keyfile := filepath.Join(dir, "team.key")
+	ioutil.WriteFile(keyfile, []byte("keyfile passphrase\n"), 0600)
+	os.Setenv("FREEDB_TEST_KEY", "env passphrase")
+	defer os.Unsetenv("FREEDB_TEST_KEY")
+
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.UseCache = false
+	kv.SetKeyProvider(NewKeyfileProvider(keyfile), NewEnvKeyProvider("FREEDB_TEST_KEY"))
+	if _, err := kv.Set("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := kv.readMetadata()
+	if m == nil || m.KDF != "envelope" || len(m.Recipients) != 2 {
+		t.Fatalf("expect the data key wrapped twice, got %v", m)
+	}
+
+	// Each provider alone can read
+	for _, provider := range []KeyProvider{NewKeyfileProvider(keyfile), NewEnvKeyProvider("FREEDB_TEST_KEY")} {
+		other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+		other.UseCache = false
+		other.SetKeyProvider(provider)
+		if record, err := other.Get("name"); err != nil || record.Content != "value" {
+			t.Errorf("expect value, got %v %v", record, err)
+		}
+	}
+
+	// A secret can not read a database of key providers
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	other.SetSecret("secret")
+	if _, err := other.Get("name"); err == nil {
+		t.Error("expect the secret to be refused")
+	}
+
+	// Rewrapping for the keyfile only drops the environment variable
+	kv.SetKeyProvider(NewKeyfileProvider(keyfile))
+	if _, err := kv.RewrapDataKey(); err != nil {
+		t.Fatal(err)
+	}
+	other.SetKeyProvider(NewEnvKeyProvider("FREEDB_TEST_KEY"))
+	if _, err := other.Get("name"); err == nil {
+		t.Error("expect the environment variable to be refused")
+	}
+	if record, err := kv.Get("name"); err != nil || record.Content != "value" {
+		t.Errorf("expect value, got %v %v", record, err)
+	}
+
+	// Two keyfiles with the same name would overwrite each other
+	os.Mkdir(filepath.Join(dir, "other"), 0700)
+	sameName := filepath.Join(dir, "other", "team.key")
+	ioutil.WriteFile(sameName, []byte("other passphrase\n"), 0600)
+	kv.SetKeyProvider(NewKeyfileProvider(keyfile), NewKeyfileProvider(sameName))
+	if _, err := kv.RewrapDataKey(); err == nil {
+		t.Error("expect the duplicate recipient to be refused")
+	}
+	kv.SetKeyProvider(NewKeyfileProvider(keyfile))
+	if record, err := kv.Get("name"); err != nil || record.Content != "value" {
+		t.Errorf("expect value, got %v %v", record, err)
+	}
+}
+
+func TestMemoryAgeProvider(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "freedb")
+	defer os.RemoveAll(dir)
+	var recipients []string
+	var identities []string
+	for i := 0; i < 3; i++ {
+		var identity [32]byte
+		rand.Read(identity[:])
+		encoded, _ := bech32Encode(ageIdentityPrefix, identity[:])
+		path := filepath.Join(dir, fmt.Sprintf("identity%d.txt", i))
+		ioutil.WriteFile(path, []byte("# created: now\n"+strings.ToUpper(encoded)+"\n"), 0600)
+		identities = append(identities, path)
+		recipient, _ := ageRecipient(identity)
+		recipients = append(recipients, recipient)
+	}
+	// The third identity is not a recipient
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	ioutil.WriteFile(recipientsFile, []byte(strings.Join(recipients[:2], "\n")), 0600)
+
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.UseCache = false
+	provider, err := NewAgeProvider(recipientsFile, identities[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetKeyProvider(provider)
+	if _, err := kv.Set("name", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, identity := range identities {
+		provider, err := NewAgeProvider("", identity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+		other.UseCache = false
+		other.SetKeyProvider(provider)
+		record, err := other.Get("name")
+		if i < 2 && (err != nil || record.Content != "value") {
+			t.Errorf("expect identity %d to read value, got %v %v", i, record, err)
+		}
+		if i == 2 && err == nil {
+			t.Errorf("expect identity %d to be refused", i)
+		}
+	}
+}
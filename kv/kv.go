@@ -1,7 +1,10 @@
 package kv
 
 import (
-	"fmt"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
 
 	helper "github.com/Gcaufy/freedb/helper"
 )
@@ -14,19 +17,65 @@ type DataBaseOption struct {
 	branch string
 }
 
-// KV is a key-value storage
+// KV is a key-value storage. Its reads and writes are safe for concurrent
+// use, the writes of a key are serialized. The setters configure the KV and
+// must not be called concurrently with other methods.
 type KV struct {
-	querier  Querier
-	secret   string
+	querier Querier
+	secret  string
+	// providers wrap the data key of databases encrypted with envelope encryption
+	providers []KeyProvider
+	// derived holds the AES keys of every database, without a data key if the database has no metadata
+	derived map[string]*keyring
+	// mu guards derived
+	mu *sync.Mutex
+	// locks serializes the reads and writes of every key
+	locks *keyLocks
+	// ctx cancels waiting for the locks of a copy made by withContext, nil otherwise
+	ctx context.Context
+	// cache holds the records read and written, by database and key
+	cache     *recordCache
+	cacheMode CacheMode
+	// disk keeps stored records between runs, nil without a disk cache
+	disk    *diskCache
+	offline bool
+	// journal keeps the writes which can not reach the host, nil without a journal
+	journal  *journal
 	UseCache bool
+	// strict makes Get fail with ErrNotFound for a missing key
+	strict bool
 }
 
-var querierMap = make(map[string]func(option *QuerierOption) Querier)
-
-var cache = make(map[string]*KeyRecord)
+var (
+	querierMu  sync.RWMutex
+	querierMap = map[string]QuerierConstructor{
+		"github.com": func(option *QuerierOption) Querier {
+			return NewGithubQuerier(option)
+		},
+		"gitlab.com": func(option *QuerierOption) Querier {
+			return NewGitlabQuerier(option)
+		},
+		"bitbucket.org": func(option *QuerierOption) Querier {
+			return NewBitbucketQuerier(option)
+		},
+		helper.LocalProvider: func(option *QuerierOption) Querier {
+			return NewLocalQuerier(option)
+		},
+	}
+)
 
 // NewKV will create a KV instace
 func NewKV(host string, token string) (*KV, error) {
+	op := newQuerierOption()
+	op.Token = token
+	return NewKVWithOption(host, op)
+}
+
+// NewKVWithOption will create a KV instance with an option, e.g. to send the
+// requests with an own HTTPClient. Host, User and Repo are parsed from host,
+// the DB, Branch and Committer left empty use the same defaults as NewKV.
+// An APIURL ending with /api/v3 selects GitHub Enterprise on any host.
+func NewKVWithOption(host string, option *QuerierOption) (*KV, error) {
 
 	parsedHost, err := helper.ParseHost(host)
 
@@ -34,34 +83,70 @@ func NewKV(host string, token string) (*KV, error) {
 		return nil, err
 	}
 
-	if len(querierMap) == 0 {
-		// TODO: we may support gitlab, bitbucket later
-		querierMap["github.com"] = func(option *QuerierOption) Querier {
+	querierMu.RLock()
+	con := querierMap[parsedHost.Provider]
+	querierMu.RUnlock()
+	if con == nil && (isGithubEnterprise(parsedHost.Provider) || isGithubAPIURL(option.APIURL)) {
+		con = func(option *QuerierOption) Querier {
 			return NewGithubQuerier(option)
 		}
 	}
-
-	con := querierMap[parsedHost.Provider]
 	if con == nil {
-		return nil, fmt.Errorf("\"%s\" is not supported currently", parsedHost.Provider)
-	}
-	op := &QuerierOption{
-		user:   parsedHost.User,
-		repo:   parsedHost.Repo,
-		token:  token,
-		db:     "default",
-		branch: "master",
-		committer: &Committer{
-			Name:  "freedb",
-			Email: "freedb@unknown.email.host",
-		},
+		// Any other host is treated as a self-hosted gitea
+		con = func(option *QuerierOption) Querier {
+			return NewGiteaQuerier(option)
+		}
+	}
+	op := *option
+	defaults := newQuerierOption()
+	if op.DB == "" {
+		op.DB = defaults.DB
 	}
-	querier := con(op)
+	if op.Branch == "" {
+		op.Branch = defaults.Branch
+	}
+	if op.Committer == nil {
+		op.Committer = defaults.Committer
+	}
+	op.Host = parsedHost.Provider
+	op.User = parsedHost.User
+	op.Repo = parsedHost.Repo
+
+	return NewKVWithQuerier(con(&op)), nil
+}
+
+// RegisterQuerier makes a querier available to NewKV for a provider, which is
+// the host name of the git link, e.g. "github.com". It replaces any querier
+// registered for the same provider, including the built-in ones. A querier which
+// does not implement ContextQuerier can not be cancelled once a query started.
+func RegisterQuerier(provider string, constructor QuerierConstructor) {
+	querierMu.Lock()
+	defer querierMu.Unlock()
+	querierMap[provider] = constructor
+}
 
+// NewKVWithQuerier will create a KV instance on top of a querier,
+// e.g. NewKVWithQuerier(NewMemoryQuerier(nil, nil)) needs no network access
+func NewKVWithQuerier(querier Querier) *KV {
 	return &KV{
 		querier:  querier,
+		derived:  make(map[string]*keyring),
+		mu:       &sync.Mutex{},
+		locks:    &keyLocks{},
+		cache:    newRecordCache(DefaultCacheSize, DefaultCacheTTL),
 		UseCache: true,
-	}, nil
+	}
+}
+
+func newQuerierOption() *QuerierOption {
+	return &QuerierOption{
+		DB:     "default",
+		Branch: "master",
+		Committer: &Committer{
+			Name:  "freedb",
+			Email: "freedb@unknown.email.host",
+		},
+	}
 }
 
 // SetHost will update the host
@@ -70,105 +155,254 @@ func (kv *KV) SetHost(host string) (bool, error) {
 	if err != nil {
 		return false, err
 	}
-	kv.querier.setHost(parsedHost.User, parsedHost.Repo)
+	kv.querier.SetHost(parsedHost.User, parsedHost.Repo)
 	return true, nil
 }
 
+// SetAPIURL is a function to update the API base URL,
+// e.g. https://github.corp.example/api/v3 or https://gitea.example.com/api/v1
+// An API URL ending with /api/v3 switches a host taken for gitea to GitHub Enterprise.
+func (kv *KV) SetAPIURL(apiURL string) {
+	if _, ok := kv.querier.(*GiteaQuerier); ok && isGithubAPIURL(apiURL) {
+		kv.querier = NewGithubQuerier(kv.querier.Option())
+	}
+	kv.querier.SetAPIURL(strings.TrimSuffix(apiURL, "/"))
+}
+
+// SetHTTPClient is a function to send the requests with client, e.g. one with
+// a timeout, a proxy or a custom CA. nil uses http.DefaultClient again.
+func (kv *KV) SetHTTPClient(client *http.Client) {
+	kv.querier.Option().HTTPClient = client
+}
+
+// SetTransport is a function to send the requests with a RoundTripper,
+// the timeout of the current client is kept
+func (kv *KV) SetTransport(transport http.RoundTripper) {
+	client := &http.Client{Transport: transport}
+	if current := kv.querier.Option().HTTPClient; current != nil {
+		client.Timeout = current.Timeout
+	}
+	kv.SetHTTPClient(client)
+}
+
 // SetBranch is a function to update the branch
 func (kv *KV) SetBranch(branch string) {
-	kv.querier.setBranch(branch)
+	kv.querier.SetBranch(branch)
 }
 
-// SetSecret is a function to set the encrypt/decrypt secret key
+// SetSecret is a function to set the encrypt/decrypt secret key.
+// The AES key is derived from it with scrypt and the salt of the database.
 func (kv *KV) SetSecret(key string) {
-	kv.secret = toMD5(key)
+	kv.secret = key
+	kv.resetDerived()
+}
+
+// SetKeyProvider is a function to encrypt with a random data key instead of a
+// secret. The data key is wrapped by every provider and stored with the
+// database, any one of them can unwrap it. Without providers, the secret is used again.
+func (kv *KV) SetKeyProvider(providers ...KeyProvider) {
+	kv.providers = providers
+	kv.resetDerived()
+}
+
+// SetStrict is a function to make Get fail with an error matching ErrNotFound
+// for a missing key, instead of returning an empty record
+func (kv *KV) SetStrict(strict bool) {
+	kv.strict = strict
 }
 
 // SetToken is a functio to update token
 func (kv *KV) SetToken(token string) {
-	kv.querier.setToken(token)
+	kv.querier.SetToken(token)
 }
 
 // Use is a function to change database
 func (kv *KV) Use(db string) {
-	kv.querier.use(db)
+	kv.querier.Use(db)
 }
 
-// Get is the function to get a key
+// Get is the function to get a key, a missing key gives an empty record
+// unless SetStrict is set
 func (kv *KV) Get(key string) (*KeyRecord, error) {
-	if kv.UseCache {
-		if cacheRecord, ok := cache[key]; ok {
-			return cacheRecord, nil
-		}
+	unlock, err := kv.lock(kv.cacheKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	record, err := kv.get(key)
+	if err == nil && kv.strict && record.Name == "" {
+		return nil, newError(ErrNotFound, "Key \"%s\" not found", key)
 	}
-	oldkey := key
-	if kv.secret != "" {
-		key = encrypt(key, kv.secret)
+	return record, err
+}
+
+func (kv *KV) get(key string) (*KeyRecord, error) {
+	if cacheRecord, ok := kv.cacheHit(key); ok {
+		return cacheRecord, nil
 	}
-	record, err := kv.querier.Get(key)
+	names, err := kv.storedNames(key, false)
 	if err != nil {
 		return nil, err
 	}
-	if kv.secret != "" {
-		if record.Content != "" {
-			record.Content = decrypt(record.Content, kv.secret)
+	// A database without metadata has no names for key providers
+	record := &KeyRecord{}
+	var name string
+	for _, name = range names {
+		record, err = kv.fetch(name)
+		if err != nil {
+			return nil, err
+		}
+		if record.Name != "" {
+			break
 		}
 	}
+	record.Content, err = kv.decryptValue(key, name, record.Content)
+	if err != nil {
+		return nil, err
+	}
 	if kv.UseCache {
-		cache[oldkey] = record
+		kv.cache.set(kv.cacheKey(key), record)
 	}
 	return record, nil
 }
 
 // Set is the function to update a key or create a new key
 func (kv *KV) Set(key string, value string) (*KeyRecord, error) {
-	oldkey := key
-	oldval := value
-	if kv.secret != "" {
-		key = encrypt(key, kv.secret)
-		value = encrypt(value, kv.secret)
+	unlock, err := kv.lock(kv.cacheKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return kv.set(key, value)
+}
+
+func (kv *KV) set(key string, value string) (*KeyRecord, error) {
+	name, err := kv.encryptKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := kv.encryptValue(name, value)
+	if err != nil {
+		return nil, err
+	}
+	record, err := kv.querier.Set(name, encrypted)
+	kv.forget(name)
+	if err != nil {
+		record, err = kv.journalWrite(key, "set", name, encrypted, err)
 	}
-	record, err := kv.querier.Set(key, value)
 	if record != nil {
-		record.Content = oldval
+		record.Content = value
 	}
 	if kv.UseCache {
-		cache[oldkey] = record
+		kv.cache.set(kv.cacheKey(key), record)
 	}
 	return record, err
 }
 
 // Append is the function to append value to a key
 func (kv *KV) Append(key string, value string) (*KeyRecord, error) {
-	record, err := kv.Get(key)
+	unlock, err := kv.lock(kv.cacheKey(key))
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
+	record, err := kv.get(key)
+	if err != nil {
+		// The content can not be read, value is added to it by Sync
+		return kv.journalAppend(key, value, err)
+	}
 	value = record.Content + value
-	return kv.Set(key, value)
+	return kv.set(key, value)
 }
 
 // Delete is the function to delete a key
 func (kv *KV) Delete(key string) (*KeyRecord, error) {
-	if kv.secret != "" {
-		key = encrypt(key, kv.secret)
+	unlock, err := kv.lock(kv.cacheKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return kv.delete(key)
+}
+
+func (kv *KV) delete(key string) (*KeyRecord, error) {
+	names, err := kv.storedNames(key, false)
+	if err != nil {
+		return nil, err
+	}
+	// Remove the copies written in older formats too,
+	// otherwise reading the key would fall back to them
+	record := &KeyRecord{}
+	defer kv.forget(names...)
+	for _, name := range names {
+		deleted, err := kv.querier.Delete(name)
+		if err != nil {
+			if deleted, err = kv.journalWrite(key, "delete", name, "", err); err != nil {
+				return nil, err
+			}
+		}
+		if record.Name == "" {
+			record = deleted
+		}
 	}
-	record, err := kv.querier.Delete(key)
 	if kv.UseCache {
-		delete(cache, key)
+		kv.cache.remove(kv.cacheKey(key))
 	}
-	return record, err
+	return record, nil
 }
 
-// Keys is the function to list all keys
+// Keys is the function to list all keys.
+// With encryption, names are decrypted and Path keeps the stored name. A name
+// which can not be decrypted is listed as stored, with Undecryptable set.
 func (kv *KV) Keys() (*[]*KeyRecord, error) {
 	record, err := kv.querier.Keys()
-	return record, err
+	if err != nil {
+		return nil, err
+	}
+	var ring *keyring
+	if kv.encrypted() {
+		if ring, err = kv.cipherKeys(false); err != nil {
+			return nil, err
+		}
+	}
+	krl := []*KeyRecord{}
+	// A key stored in several formats is listed once, as Get reads it
+	index := make(map[string]int)
+	rank := make(map[string]int)
+	for _, kr := range *record {
+		if kr.Name == metadataFile {
+			continue
+		}
+		if !kv.encrypted() {
+			krl = append(krl, kr)
+			continue
+		}
+		name, r, decryptErr := kv.decryptName(kr.Name, ring)
+		if decryptErr != nil {
+			kr.Undecryptable = true
+			krl = append(krl, kr)
+			continue
+		}
+		kr.Name = name
+		if i, ok := index[name]; ok {
+			if r < rank[name] {
+				krl[i] = kr
+				rank[name] = r
+			}
+			continue
+		}
+		index[name] = len(krl)
+		rank[name] = r
+		krl = append(krl, kr)
+	}
+	return &krl, nil
 }
 
 // ClearCache can clear the current cache
 func (kv *KV) ClearCache() {
-	for k := range cache {
-		delete(cache, k)
+	kv.cache.clear()
+	kv.resetDerived()
+	if kv.disk != nil {
+		kv.disk.clear(kv.location())
 	}
 }
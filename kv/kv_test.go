@@ -1,24 +1,35 @@
 package kv
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestGet(t *testing.T) {
 
 	token := os.Getenv("TEST_REPO_TOKEN")
 	if token == "" {
-		t.Error("Please set a token")
-		return
+		t.Skip("TEST_REPO_TOKEN is not set")
 	}
 	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", token)
-	kv.Use("golang")
 	if err != nil {
-		t.Error("Should not be error")
-		t.Error(err)
+		t.Fatal(err)
 	}
-	_, err = kv.Set("key-exist", "123")
+	kv.Use("golang")
+	testKV(t, kv)
+}
+
+func TestMemoryGet(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.Use("golang")
+	testKV(t, kv)
+}
+
+func testKV(t *testing.T, kv *KV) {
+	_, err := kv.Set("key-exist", "123")
 	if err != nil {
 		t.Error(err)
 	}
@@ -42,3 +53,605 @@ func TestGet(t *testing.T) {
 		t.Error("Should have at least one key there")
 	}
 }
+
+func TestMemoryConflict(t *testing.T) {
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.UseCache = false
+	other.UseCache = false
+
+	first, err := kv.Set("key", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// other does not know the sha yet, it gets a 422 and retries
+	if _, err = other.Set("key", "2"); err != nil {
+		t.Fatal(err)
+	}
+	// kv holds a stale sha now, it gets a 409 and retries
+	second, err := kv.Set("key", "3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Commit == second.Commit || len(second.Commit) != 40 {
+		t.Errorf("expect a new commit, got %s and %s", first.Commit, second.Commit)
+	}
+	if record, _ := other.Get("key"); record.Content != "3" {
+		t.Errorf("expect 3, got %s", record.Content)
+	}
+	if _, err = other.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if record, err := kv.Delete("key"); err != nil || record.Name != "" {
+		t.Errorf("expect key to be missing, got %v %v", record, err)
+	}
+}
+
+func TestRegisterQuerier(t *testing.T) {
+	store := NewMemoryStore()
+	RegisterQuerier("memory.test", func(option *QuerierOption) Querier {
+		return NewMemoryQuerier(store, option)
+	})
+	kv, err := NewKV("git@memory.test:Gcaufy-Test/test-database.git", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	option := kv.querier.Option()
+	if option.Host != "memory.test" || option.User != "Gcaufy-Test" || option.Token != "token" {
+		t.Errorf("unexpected option %+v", option)
+	}
+	if _, err = kv.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.files) != 1 {
+		t.Error("expect the registered querier to be used")
+	}
+}
+
+func TestMemoryBatch(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.UseCache = false
+	if _, err := kv.Set("stale", "1"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := kv.Batch().Set("a", "1").Set("b", "2").Delete("stale").Set("a", "3").Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ := kv.Keys()
+	if len(*list) != 2 {
+		t.Errorf("expect 2 keys, got %d", len(*list))
+	}
+	for _, kr := range *list {
+		if kr.Commit != record.Commit {
+			t.Errorf("expect %s to be written by commit %s", kr.Name, record.Commit)
+		}
+	}
+	if a, _ := kv.Get("a"); a.Content != "3" {
+		t.Errorf("expect the last op to win, got %s", a.Content)
+	}
+}
+
+func TestMemorySetIfMatch(t *testing.T) {
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.UseCache = false
+	other.UseCache = false
+
+	first, err := kv.SetIfNotExists("key", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = other.SetIfNotExists("key", "2"); err == nil {
+		t.Error("expect SetIfNotExists to fail on an existing key")
+	}
+	second, err := other.SetIfMatch("key", "2", first.Sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// kv still holds the first sha, it must not clobber the write of other
+	_, err = kv.SetIfMatch("key", "3", first.Sha)
+	conflict, ok := err.(*ConflictError)
+	if !ok || conflict.Key != "key" || conflict.Expected != first.Sha {
+		t.Fatalf("expect a conflict, got %v", err)
+	}
+	if _, err = kv.SetIfMatch("key", "3", second.Commit); err != nil {
+		t.Errorf("expect the commit to match, got %v", err)
+	}
+	if record, _ := other.Get("key"); record.Content != "3" {
+		t.Errorf("expect 3, got %s", record.Content)
+	}
+
+	// A later commit which did not touch the key matches too, an older one does not
+	later, _ := other.Set("unrelated", "1")
+	if _, err = kv.SetIfMatch("key", "4", later.Commit); err != nil {
+		t.Errorf("expect the later commit to match, got %v", err)
+	}
+	if _, err = kv.SetIfMatch("key", "5", later.Commit); err == nil {
+		t.Error("expect the key to have changed since the commit")
+	}
+}
+
+func TestMemoryHistory(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.UseCache = false
+	kv.SetSecret("secret")
+	first, _ := kv.Set("key", "1")
+	kv.Set("other", "x")
+	second, _ := kv.Set("key", "2")
+	kv.Delete("key")
+
+	history, err := kv.History("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[1].Commit != second.Commit || history[2].Commit != first.Commit {
+		t.Fatalf("unexpected history %v", history)
+	}
+	if history[0].Message != "freedb delete a key from golang client" || history[0].Author != "freedb" {
+		t.Errorf("unexpected revision %+v", history[0])
+	}
+	if record, err := kv.GetAt("key", first.Commit); err != nil || record.Content != "1" {
+		t.Errorf("expect 1 at %s, got %v %v", first.Commit, record, err)
+	}
+	if record, _ := kv.GetAt("key", history[0].Commit); record.Name != "" {
+		t.Errorf("expect key to be deleted, got %v", record)
+	}
+	at := history[1].Date.Format(time.RFC3339Nano)
+	if record, _ := kv.GetAt("key", at); record.Content != "2" {
+		t.Errorf("expect 2 at %s, got %v", at, record)
+	}
+	if record, _ := kv.GetAt("key", "2000-01-01"); record.Name != "" {
+		t.Errorf("expect key to be missing in 2000, got %v", record)
+	}
+	if _, err = kv.GetAt("key", "unknown"); err == nil {
+		t.Error("expect an unknown revision to fail")
+	}
+}
+
+func TestMemoryRevert(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.UseCache = false
+	kv.SetSecret("secret")
+	first, _ := kv.Batch().Set("a", "1").Set("b", "1").Set("c", "1").Exec()
+	kv.Set("a", "2")
+	kv.Delete("b")
+	kv.Set("d", "2")
+
+	if record, err := kv.Revert("a", first.Commit); err != nil || record.Content != "1" {
+		t.Errorf("expect a to be reverted, got %v %v", record, err)
+	}
+	if record, _ := kv.Get("a"); record.Content != "1" {
+		t.Errorf("expect 1, got %s", record.Content)
+	}
+	kv.Set("a", "3")
+	record, err := kv.RestoreDatabase(first.Commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a, b and d change in one commit, c is untouched
+	for _, key := range []string{"a", "b", "d"} {
+		history, _ := kv.History(key)
+		if history[0].Commit != record.Commit {
+			t.Errorf("expect %s to be restored by %s", key, record.Commit)
+		}
+	}
+	if history, _ := kv.History("c"); len(history) != 1 {
+		t.Errorf("expect c to be untouched, got %v", history)
+	}
+	list, _ := kv.Keys()
+	if len(*list) != 3 {
+		t.Errorf("expect 3 keys, got %d", len(*list))
+	}
+	if b, _ := kv.Get("b"); b.Content != "1" {
+		t.Errorf("expect b to be restored, got %v", b)
+	}
+	if record, _ = kv.RestoreDatabase(first.Commit); record.Commit != "" {
+		t.Errorf("expect nothing to restore, got %s", record.Commit)
+	}
+
+	// A point in time restores the last commit before it
+	kv.Set("a", "4")
+	history, _ := kv.History("a")
+	at := history[1].Date.Format(time.RFC3339Nano)
+	if _, err := kv.RestoreDatabase(at); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := kv.Get("a"); a.Content != "1" {
+		t.Errorf("expect a to be restored at %s, got %v", at, a)
+	}
+	if _, err := kv.RestoreDatabase("2000-01-01"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expect no commit in 2000, got %v", err)
+	}
+}
+
+func TestMemoryRestoreRotatedDatabase(t *testing.T) {
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.UseCache = false
+	kv.SetSecret("old")
+	before, _ := kv.Set("a", "1")
+	if _, err := kv.RotateSecret("old", "new", false); err != nil {
+		t.Fatal(err)
+	}
+	kv.Set("b", "2")
+
+	// The salt is restored with the keys, which only the old secret decrypts
+	if _, err := kv.RestoreDatabase(before.Commit); err != nil {
+		t.Fatal(err)
+	}
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	other.SetSecret("old")
+	if record, err := other.Get("a"); err != nil || record.Content != "1" {
+		t.Errorf("expect the old secret to read a, got %v %v", record, err)
+	}
+	if list, err := other.Keys(); err != nil || len(*list) != 1 {
+		t.Errorf("expect a single key, got %v %v", list, err)
+	}
+	kv.SetSecret("old")
+	if record, err := kv.Get("a"); err != nil || record.Content != "1" {
+		t.Errorf("expect the restoring KV to read a with the old secret, got %v %v", record, err)
+	}
+}
+
+func TestMemoryDotKeys(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.UseCache = false
+	first, _ := kv.Batch().Set(".env", "1").Set("a", "1").Exec()
+	if list, err := kv.Keys(); err != nil || len(*list) != 2 {
+		t.Errorf("expect .env to be listed, got %v %v", list, err)
+	}
+	kv.Delete(".env")
+	if _, err := kv.RestoreDatabase(first.Commit); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := kv.Get(".env"); record.Content != "1" {
+		t.Errorf("expect .env to be restored, got %v", record)
+	}
+
+	// Only the metadata is hidden
+	kv.SetSecret("secret")
+	kv.Set(".b", "2")
+	if list, err := kv.Keys(); err != nil || len(*list) != 3 {
+		t.Errorf("expect the metadata to be hidden, got %v %v", list, err)
+	}
+}
+
+func TestMemoryLegacySecret(t *testing.T) {
+	querier := NewMemoryQuerier(nil, nil)
+	kv := NewKVWithQuerier(querier)
+	kv.UseCache = false
+	kv.SetSecret("secret")
+	// A key written by an older version
+	querier.Set(legacyEncrypt("key", toMD5("secret")), legacyEncrypt("old", toMD5("secret")))
+
+	if record, err := kv.Get("key"); err != nil || record.Content != "old" {
+		t.Fatalf("expect old, got %v %v", record, err)
+	}
+	if _, err := kv.Set("key", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := kv.Get("key"); record.Content != "new" {
+		t.Errorf("expect new, got %s", record.Content)
+	}
+	if _, err := kv.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if record, _ := kv.Get("key"); record.Name != "" {
+		t.Errorf("expect both copies to be deleted, got %v", record)
+	}
+
+	name, _ := kv.encryptKey("broken")
+	querier.Set(name, "0123")
+	if _, err := kv.Get("broken"); err == nil {
+		t.Error("expect a broken value to fail")
+	}
+}
+
+func TestMemorySecretSalt(t *testing.T) {
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.SetSecret("secret")
+	kv.Use("a")
+	if _, err := kv.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	kv.Use("b")
+	kv.Set("key", "value")
+
+	// A new client with the same secret reads the salt of every database
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	other.SetSecret("secret")
+	other.Use("a")
+	if record, err := other.Get("key"); err != nil || record.Content != "value" {
+		t.Fatalf("expect value, got %v %v", record, err)
+	}
+	list, _ := other.Keys()
+	if len(*list) != 1 {
+		t.Errorf("expect the metadata to be hidden, got %v", *list)
+	}
+	nameA := baseName((*list)[0].Path)
+	other.Use("b")
+	if list, _ = other.Keys(); baseName((*list)[0].Path) == nameA {
+		t.Error("expect databases to have different salts")
+	}
+	m, err := other.readMetadata()
+	if err != nil || m == nil || m.KDF != "scrypt" || len(m.Salt) == 0 {
+		t.Errorf("unexpected metadata %+v %v", m, err)
+	}
+
+	other.SetSecret("wrong")
+	if record, _ := other.Get("key"); record.Name != "" {
+		t.Errorf("expect key to be missing with a wrong secret, got %v", record)
+	}
+}
+
+func TestMemoryLegacyDatabase(t *testing.T) {
+	querier := NewMemoryQuerier(nil, nil)
+	legacy := toMD5("secret")
+	// Written before the databases had metadata
+	querier.Set(legacyEncrypt("cbc", legacy), legacyEncrypt("1", legacy))
+
+	kv := NewKVWithQuerier(querier)
+	kv.UseCache = false
+	kv.SetSecret("secret")
+	if record, _ := kv.Get("cbc"); record.Content != "1" {
+		t.Errorf("expect 1, got %v", record)
+	}
+	// The first write adds the metadata, old keys stay readable
+	if _, err := kv.Set("new", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := kv.readMetadata(); m == nil || !m.Legacy {
+		t.Errorf("expect the metadata to be created for a legacy database, got %+v", m)
+	}
+	for key, expect := range map[string]string{"cbc": "1", "new": "2"} {
+		if record, err := kv.Get(key); err != nil || record.Content != expect {
+			t.Errorf("expect %s to be %s, got %v %v", key, expect, record, err)
+		}
+	}
+	if _, err := kv.Batch().Delete("cbc").Delete("missing").Exec(); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := kv.Keys(); len(*list) != 1 {
+		t.Errorf("expect 1 key, got %d", len(*list))
+	}
+}
+
+func TestMemorySwappedValues(t *testing.T) {
+	querier := NewMemoryQuerier(nil, nil)
+	kv := NewKVWithQuerier(querier)
+	kv.UseCache = false
+	kv.SetSecret("secret")
+	kv.Batch().Set("a", "1").Set("b", "2").Exec()
+
+	nameA, _ := kv.encryptKey("a")
+	nameB, _ := kv.encryptKey("b")
+	stored, _ := querier.Get(nameB)
+	// Whoever can write to the repository can not move a value to another key
+	querier.Set(nameA, stored.Content)
+	if record, err := kv.Get("a"); err == nil {
+		t.Errorf("expect the value of b not to open as a, got %v", record)
+	}
+	if record, err := kv.Get("b"); err != nil || record.Content != "2" {
+		t.Errorf("expect 2, got %v %v", record, err)
+	}
+}
+
+func TestMemoryNewDatabaseWithoutLegacyKey(t *testing.T) {
+	querier := NewMemoryQuerier(nil, nil)
+	kv := NewKVWithQuerier(querier)
+	kv.SetSecret("secret")
+	if _, err := kv.Set("key", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := kv.readMetadata(); m == nil || m.Legacy {
+		t.Errorf("expect the metadata of a new database not to be legacy, got %+v", m)
+	}
+	if names, _ := kv.storedNames("key", false); len(names) != 1 {
+		t.Errorf("expect a single name, got %v", names)
+	}
+	// A value sealed with the MD5 of the secret is not opened
+	legacy := toMD5("secret")
+	querier.Set(legacyEncrypt("cbc", legacy), legacyEncrypt("1", legacy))
+	if record, _ := kv.Get("cbc"); record.Name != "" {
+		t.Errorf("expect cbc to be missing, got %v", record)
+	}
+}
+
+func TestMemoryRotateSecret(t *testing.T) {
+	store := NewMemoryStore()
+	querier := NewMemoryQuerier(store, nil)
+	legacy := toMD5("old")
+	// A key written before the databases had metadata
+	querier.Set(legacyEncrypt("legacy", legacy), legacyEncrypt("1", legacy))
+
+	kv := NewKVWithQuerier(querier)
+	kv.SetSecret("old")
+	kv.Batch().Set("a", "2").Set("b", "3").Exec()
+
+	if _, err := kv.RotateSecret("wrong", "new", false); err == nil {
+		t.Error("expect a wrong old secret to fail")
+	}
+	rotation, err := kv.RotateSecret("old", "new", true)
+	if err != nil || len(rotation.Keys) != 3 || rotation.Commit != "" {
+		t.Fatalf("unexpected dry run %+v %v", rotation, err)
+	}
+	// The legacy key, the metadata and the batch
+	if len(store.log) != 3 {
+		t.Errorf("expect a dry run to write nothing, got %d commits", len(store.log))
+	}
+
+	rotation, err = kv.RotateSecret("old", "new", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.log) != 4 || rotation.Commit != store.log[3].revision.Commit {
+		t.Errorf("expect a single commit, got %d commits", len(store.log))
+	}
+	if list, _ := kv.Keys(); len(*list) != 3 {
+		t.Errorf("expect old names to be deleted, got %v", *list)
+	}
+
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	other.SetSecret("new")
+	for key, expect := range map[string]string{"legacy": "1", "a": "2", "b": "3"} {
+		if record, err := other.Get(key); err != nil || record.Content != expect {
+			t.Errorf("expect %s to be %s, got %v %v", key, expect, record, err)
+		}
+	}
+	other.SetSecret("old")
+	if record, _ := other.Get("a"); record.Name != "" {
+		t.Errorf("expect the old secret to be useless, got %v", record)
+	}
+}
+
+func TestMemoryRotateEmptySecret(t *testing.T) {
+	store := NewMemoryStore()
+	kv := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	kv.UseCache = false
+	kv.SetSecret("old")
+	rotation, err := kv.RotateSecret("old", "new", false)
+	if err != nil || len(rotation.Keys) != 0 || rotation.Commit == "" {
+		t.Fatalf("expect the salt to be written, got %+v %v", rotation, err)
+	}
+	if kv.secret != "new" {
+		t.Errorf("expect the new secret to be used, got %s", kv.secret)
+	}
+	kv.Set("a", "1")
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.SetSecret("new")
+	if record, err := other.Get("a"); err != nil || record.Content != "1" {
+		t.Errorf("expect the new secret to read a, got %v %v", record, err)
+	}
+}
+
+// racingQuerier runs write before listing the keys, like a client writing
+// while the keys are read
+type racingQuerier struct {
+	*MemoryQuerier
+	write func()
+}
+
+func (q *racingQuerier) Keys() (*[]*KeyRecord, error) {
+	if q.write != nil {
+		q.write()
+		q.write = nil
+	}
+	return q.MemoryQuerier.Keys()
+}
+
+func TestMemoryRotateSecretRace(t *testing.T) {
+	store := NewMemoryStore()
+	querier := &racingQuerier{MemoryQuerier: NewMemoryQuerier(store, nil)}
+	kv := NewKVWithQuerier(querier)
+	kv.UseCache = false
+	kv.SetSecret("old")
+	kv.Set("a", "1")
+
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	other.SetSecret("old")
+	querier.write = func() { other.Set("b", "2") }
+	commits := len(store.log)
+	if _, err := kv.RotateSecret("old", "new", false); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expect the rotation to conflict, got %v", err)
+	}
+	if len(store.log) != commits+1 {
+		t.Errorf("expect the rotation to write nothing, got %d commits", len(store.log)-commits)
+	}
+	// Once retried, every key is rotated
+	if _, err := kv.RotateSecret("old", "new", false); err != nil {
+		t.Fatal(err)
+	}
+	other.SetSecret("new")
+	for key, expect := range map[string]string{"a": "1", "b": "2"} {
+		if record, err := other.Get(key); err != nil || record.Content != expect {
+			t.Errorf("expect %s to be %s, got %v %v", key, expect, record, err)
+		}
+	}
+}
+
+func TestMemoryRestoreDatabaseRace(t *testing.T) {
+	store := NewMemoryStore()
+	querier := &racingQuerier{MemoryQuerier: NewMemoryQuerier(store, nil)}
+	kv := NewKVWithQuerier(querier)
+	kv.UseCache = false
+	first, _ := kv.Set("a", "1")
+	kv.Set("a", "2")
+
+	other := NewKVWithQuerier(NewMemoryQuerier(store, nil))
+	other.UseCache = false
+	querier.write = func() { other.Set("b", "2") }
+	commits := len(store.log)
+	if _, err := kv.RestoreDatabase(first.Commit); !errors.Is(err, ErrConflict) {
+		t.Fatalf("expect the restore to conflict, got %v", err)
+	}
+	if len(store.log) != commits+1 {
+		t.Errorf("expect the restore to write nothing, got %d commits", len(store.log)-commits)
+	}
+	// Once retried, the key written meanwhile is deleted too
+	if _, err := kv.RestoreDatabase(first.Commit); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := kv.Keys(); len(*list) != 1 {
+		t.Errorf("expect a single key, got %d", len(*list))
+	}
+}
+
+func TestMemoryKeysWithSecret(t *testing.T) {
+	querier := NewMemoryQuerier(nil, nil)
+	legacy := toMD5("secret")
+	querier.Set(legacyEncrypt("a", legacy), legacyEncrypt("old", legacy))
+	querier.Set("plain", "1")
+
+	kv := NewKVWithQuerier(querier)
+	kv.UseCache = false
+	kv.SetSecret("secret")
+	kv.Set("a", "new")
+	kv.Set("b", "2")
+
+	list, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]*KeyRecord)
+	for _, kr := range *list {
+		names[kr.Name] = kr
+	}
+	if len(*list) != 3 || names["a"] == nil || names["b"] == nil || names["plain"] == nil {
+		t.Fatalf("expect a, b and plain, got %v", *list)
+	}
+	// a is stored twice, the copy Get reads is listed
+	if name, _ := kv.encryptKey("a"); names["a"].Path != "default/"+name || names["a"].Undecryptable {
+		t.Errorf("unexpected record %+v", names["a"])
+	}
+	if !names["plain"].Undecryptable || names["plain"].Path != "default/plain" {
+		t.Errorf("expect plain to be undecryptable, got %+v", names["plain"])
+	}
+}
+
+func TestMemoryKeysWithWrongSecret(t *testing.T) {
+	// The legacy format is not authenticated, a wrong key sometimes unpads
+	alice := toMD5("alice")
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.SetSecret("bob")
+	keys, err := kv.cipherKeys(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4000; i++ {
+		stored := legacyEncrypt(fmt.Sprintf("%03d", i), alice)
+		if name, _, err := kv.decryptName(stored, keys); err == nil {
+			t.Errorf("expect %s not to decrypt, got %q", stored, name)
+		}
+	}
+	if name, _, err := kv.decryptName(legacyEncrypt("001", toMD5("bob")), keys); err != nil || name != "001" {
+		t.Errorf("expect 001, got %q %v", name, err)
+	}
+}
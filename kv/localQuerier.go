@@ -0,0 +1,561 @@
+package kv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LocalQuerier is a querier for a local git repository, bare or not.
+// It drives git plumbing commands directly, so no hosting provider is needed.
+// The working tree of a non-bare repository is never touched.
+type LocalQuerier struct {
+	option    *QuerierOption
+	committer *Committer
+	// mu serializes the commits of the querier, update-ref only makes
+	// concurrent commits fail instead of losing one of them
+	mu *sync.Mutex
+	// ctx kills the git commands of a copy made by WithContext, nil otherwise
+	ctx context.Context
+}
+
+type localError struct {
+	Message string
+	// err is the sentinel error matched, if any
+	err error
+}
+
+func (e *localError) Error() string {
+	return e.Message
+}
+
+func (e *localError) Unwrap() error {
+	return e.err
+}
+
+type localTreeEntry struct {
+	mode string
+	kind string
+	sha  string
+	size int
+	path string
+}
+
+// NewLocalQuerier is a querier constructor, option.Repo is the repository path
+func NewLocalQuerier(option *QuerierOption) *LocalQuerier {
+	return &LocalQuerier{
+		option:    option,
+		committer: option.Committer,
+		mu:        &sync.Mutex{},
+	}
+}
+
+// Keys is a function to list all keys
+func (q *LocalQuerier) Keys() (*[]*KeyRecord, error) {
+	head, err := q.head()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return &[]*KeyRecord{}, nil
+	}
+	krl, err := q.keysAt(head)
+	if err != nil {
+		return nil, err
+	}
+	return krl, nil
+}
+
+func (q *LocalQuerier) keysAt(commit string) (*[]*KeyRecord, *localError) {
+	entries, err := q.lsTree(commit, q.option.DB+"/")
+	if err != nil {
+		return nil, err
+	}
+	krl := []*KeyRecord{}
+	for _, entry := range entries {
+		if entry.kind != "blob" {
+			continue
+		}
+		krl = append(krl, entry.transfer())
+	}
+	return &krl, nil
+}
+
+// Get is a function to read a key
+func (q *LocalQuerier) Get(key string) (*KeyRecord, error) {
+	head, err := q.head()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return &KeyRecord{}, nil
+	}
+	entry, err := q.entry(head, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return &KeyRecord{}, nil
+	}
+	content, err := q.git(nil, "", "cat-file", "blob", entry.sha)
+	if err != nil {
+		return nil, err
+	}
+	record := entry.transfer()
+	record.Content = content
+	return record, nil
+}
+
+// Set is a function to set a key
+func (q *LocalQuerier) Set(key string, value string) (*KeyRecord, error) {
+	sha, err := q.git(nil, value, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return nil, err
+	}
+	sha = strings.TrimSpace(sha)
+	commit, err := q.commit("freedb update a key from golang client", q.indexInfo(key, sha))
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{
+		Name:   baseName(key),
+		Size:   len(value),
+		Sha:    sha,
+		Commit: commit,
+		Path:   q.path(key),
+	}, nil
+}
+
+// SetIfMatch is a function to set a key only if it still matches expected
+func (q *LocalQuerier) SetIfMatch(key string, value string, expected string) (*KeyRecord, error) {
+	sha, err := q.git(nil, value, "hash-object", "-w", "--stdin")
+	if err != nil {
+		return nil, err
+	}
+	sha = strings.TrimSpace(sha)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		head, err := q.head()
+		if err != nil {
+			return nil, err
+		}
+		if !q.match(head, key, expected) {
+			return nil, &ConflictError{Key: key, Expected: expected}
+		}
+		commit, err := q.commitOn(head, "freedb update a key from golang client", q.indexInfo(key, sha))
+		if err != nil {
+			// Check again on top of the new head if the branch moved
+			if newHead, _ := q.head(); newHead == head {
+				return nil, err
+			}
+			continue
+		}
+		return &KeyRecord{
+			Name:   baseName(key),
+			Size:   len(value),
+			Sha:    sha,
+			Commit: commit,
+			Path:   q.path(key),
+		}, nil
+	}
+	return nil, &ConflictError{Key: key, Expected: expected}
+}
+
+// match reports whether the key at head matches expected, see ConditionalQuerier
+func (q *LocalQuerier) match(head string, key string, expected string) bool {
+	var current *localTreeEntry
+	if head != "" {
+		current, _ = q.entry(head, key)
+	}
+	if expected == "" || current == nil {
+		return expected == "" && current == nil
+	}
+	if current.sha == expected {
+		return true
+	}
+	past, err := q.entry(expected, key)
+	return err == nil && past != nil && past.sha == current.sha
+}
+
+// Delete is a function to delete a key
+func (q *LocalQuerier) Delete(key string) (*KeyRecord, error) {
+	head, err := q.head()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return &KeyRecord{}, nil
+	}
+	entry, err := q.entry(head, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil { // The key do not exist, can not delete it
+		return &KeyRecord{}, nil
+	}
+	commit, err := q.commit("freedb delete a key from golang client", q.indexInfo(key, ""))
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{
+		Name:   baseName(key),
+		Commit: commit,
+		Path:   q.path(key),
+	}, nil
+}
+
+// Batch is a function to write several keys in one commit
+func (q *LocalQuerier) Batch(ops []*BatchOp) (*KeyRecord, error) {
+	indexInfo, err := q.batchIndexInfo(ops)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := q.commit(fmt.Sprintf("freedb update %d keys from golang client", len(ops)), indexInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyRecord{Commit: commit}, nil
+}
+
+// Head is a function to get the commit the branch points to
+func (q *LocalQuerier) Head() (string, error) {
+	head, err := q.head()
+	if err != nil {
+		return "", err
+	}
+	return head, nil
+}
+
+// BatchOn is a function to write several keys in one commit whose parent is head
+func (q *LocalQuerier) BatchOn(ops []*BatchOp, head string) (*KeyRecord, error) {
+	indexInfo, err := q.batchIndexInfo(ops)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	commit, err := q.commitOn(head, fmt.Sprintf("freedb update %d keys from golang client", len(ops)), indexInfo)
+	if err != nil {
+		if current, _ := q.head(); current != head {
+			return nil, &localError{Message: fmt.Sprintf("Branch \"%s\" has moved since %s", q.option.Branch, head), err: ErrConflict}
+		}
+		return nil, err
+	}
+	return &KeyRecord{Commit: commit}, nil
+}
+
+// batchIndexInfo writes the values of ops and returns their index lines
+func (q *LocalQuerier) batchIndexInfo(ops []*BatchOp) (string, *localError) {
+	var indexInfo string
+	for _, op := range ops {
+		sha := ""
+		if op.Value != nil {
+			var err *localError
+			sha, err = q.git(nil, *op.Value, "hash-object", "-w", "--stdin")
+			if err != nil {
+				return "", err
+			}
+			sha = strings.TrimSpace(sha)
+		}
+		indexInfo += q.indexInfo(op.Key, sha)
+	}
+	return indexInfo, nil
+}
+
+// History is a function to list the commits which touched a key
+func (q *LocalQuerier) History(key string) ([]*Revision, error) {
+	history := []*Revision{}
+	head, err := q.head()
+	if err != nil {
+		return nil, err
+	}
+	if head == "" {
+		return history, nil
+	}
+	out, err := q.git(nil, "", "log", "-z", "--format=%H%x1f%an%x1f%ae%x1f%aI%x1f%B", head, "--", q.path(key))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(out, "\x00") {
+		fields := strings.SplitN(line, "\x1f", 5)
+		if len(fields) != 5 {
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, fields[3])
+		history = append(history, &Revision{
+			Commit:  fields[0],
+			Author:  fields[1],
+			Email:   fields[2],
+			Date:    date,
+			Message: strings.TrimSpace(fields[4]),
+		})
+	}
+	return history, nil
+}
+
+// GetAt is a function to read a key at a commit, a tag or a branch
+func (q *LocalQuerier) GetAt(key string, ref string) (*KeyRecord, error) {
+	commit, err := q.revParse(ref)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := q.entry(commit, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return &KeyRecord{}, nil
+	}
+	content, err := q.git(nil, "", "cat-file", "blob", entry.sha)
+	if err != nil {
+		return nil, err
+	}
+	record := entry.transfer()
+	record.Content = content
+	return record, nil
+}
+
+// KeysAt is a function to list all keys at a commit, a tag or a branch
+func (q *LocalQuerier) KeysAt(ref string) (*[]*KeyRecord, error) {
+	commit, err := q.revParse(ref)
+	if err != nil {
+		return nil, err
+	}
+	krl, err := q.keysAt(commit)
+	if err != nil {
+		return nil, err
+	}
+	return krl, nil
+}
+
+// SetHost is a function to update the repository
+func (q *LocalQuerier) SetHost(user, repo string) {
+	q.option.User = user
+	q.option.Repo = repo
+}
+
+// SetAPIURL is a function to update the API base URL
+func (q *LocalQuerier) SetAPIURL(apiURL string) {
+	q.option.APIURL = apiURL
+}
+
+// SetBranch is a function to update the branch
+func (q *LocalQuerier) SetBranch(branch string) {
+	q.option.Branch = branch
+}
+
+// Use is a function to change database
+func (q *LocalQuerier) Use(db string) {
+	q.option.DB = db
+}
+
+// SetToken is a function to update the token
+func (q *LocalQuerier) SetToken(token string) {
+	q.option.Token = token
+}
+
+// Option is a function to get the current option
+func (q *LocalQuerier) Option() *QuerierOption {
+	return q.option
+}
+
+// WithContext is a function to get a copy of the querier whose git commands are killed when ctx is done
+func (q *LocalQuerier) WithContext(ctx context.Context) Querier {
+	c := *q
+	c.ctx = ctx
+	return &c
+}
+
+func (q *LocalQuerier) path(key string) string {
+	return q.option.DB + "/" + key
+}
+
+func (q *LocalQuerier) ref() string {
+	return "refs/heads/" + q.option.Branch
+}
+
+// head returns the commit of the branch, or "" if the branch does not exist yet
+func (q *LocalQuerier) head() (string, *localError) {
+	out, err := q.git(nil, "", "for-each-ref", "--format=%(objectname)", q.ref())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// revParse resolves a commit, a tag or a branch to a commit
+func (q *LocalQuerier) revParse(ref string) (string, *localError) {
+	commit, err := q.git(nil, "", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return "", &localError{Message: fmt.Sprintf("Revision \"%s\" not found", ref), err: ErrNotFound}
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+// entry returns the tree entry of a key, or nil if the key does not exist
+func (q *LocalQuerier) entry(commit string, key string) (*localTreeEntry, *localError) {
+	entries, err := q.lsTree(commit, q.path(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	if entries[0].kind != "blob" {
+		return nil, &localError{Message: fmt.Sprintf("'%s' is a folder", key), err: ErrIsFolder}
+	}
+	return entries[0], nil
+}
+
+func (q *LocalQuerier) lsTree(commit string, path string) ([]*localTreeEntry, *localError) {
+	out, err := q.git(nil, "", "ls-tree", "-z", "-l", commit, "--", path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*localTreeEntry
+	for _, line := range strings.Split(out, "\x00") {
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		tab := strings.Index(line, "\t")
+		if tab == -1 {
+			continue
+		}
+		fields := strings.Fields(line[:tab])
+		if len(fields) != 4 {
+			continue
+		}
+		size, _ := strconv.Atoi(fields[3])
+		entries = append(entries, &localTreeEntry{
+			mode: fields[0],
+			kind: fields[1],
+			sha:  fields[2],
+			size: size,
+			path: line[tab+1:],
+		})
+	}
+	return entries, nil
+}
+
+// indexInfo is an "update-index -z --index-info" entry, an empty sha removes the key
+func (q *LocalQuerier) indexInfo(key string, sha string) string {
+	if sha == "" {
+		return "0 0000000000000000000000000000000000000000\t" + q.path(key) + "\x00"
+	}
+	return "100644 " + sha + "\t" + q.path(key) + "\x00"
+}
+
+// commit applies the index entries on top of the branch, commits the new
+// tree and moves the branch to it. If the branch moves in the meantime,
+// it tries once more on top of the new head.
+func (q *LocalQuerier) commit(message string, indexInfo string) (string, *localError) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var err *localError
+	for i := 0; i < 2; i++ {
+		var commit string
+		commit, err = q.tryCommit(message, indexInfo)
+		if err == nil {
+			return commit, nil
+		}
+	}
+	return "", err
+}
+
+func (q *LocalQuerier) tryCommit(message string, indexInfo string) (string, *localError) {
+	head, err := q.head()
+	if err != nil {
+		return "", err
+	}
+	return q.commitOn(head, message, indexInfo)
+}
+
+// commitOn commits on top of head, it fails if the branch is not at head any more
+func (q *LocalQuerier) commitOn(head string, message string, indexInfo string) (string, *localError) {
+	dir, tmpErr := ioutil.TempDir("", "freedb")
+	if tmpErr != nil {
+		return "", &localError{Message: tmpErr.Error()}
+	}
+	defer os.RemoveAll(dir)
+	env := append(q.committerEnv(), "GIT_INDEX_FILE="+filepath.Join(dir, "index"))
+
+	if head != "" {
+		if _, err := q.git(env, "", "read-tree", head); err != nil {
+			return "", err
+		}
+	}
+	if _, err := q.git(env, indexInfo, "update-index", "-z", "--index-info"); err != nil {
+		return "", err
+	}
+	tree, err := q.git(env, "", "write-tree")
+	if err != nil {
+		return "", err
+	}
+	args := []string{"commit-tree", strings.TrimSpace(tree), "-m", message}
+	if head != "" {
+		args = append(args, "-p", head)
+	}
+	commit, err := q.git(env, "", args...)
+	if err != nil {
+		return "", err
+	}
+	commit = strings.TrimSpace(commit)
+	// An empty old value makes sure the branch is still missing
+	if _, err = q.git(env, "", "update-ref", "-m", message, q.ref(), commit, head); err != nil {
+		return "", err
+	}
+	return commit, nil
+}
+
+func (q *LocalQuerier) committerEnv() []string {
+	if q.committer == nil {
+		return nil
+	}
+	return []string{
+		"GIT_AUTHOR_NAME=" + q.committer.Name,
+		"GIT_AUTHOR_EMAIL=" + q.committer.Email,
+		"GIT_COMMITTER_NAME=" + q.committer.Name,
+		"GIT_COMMITTER_EMAIL=" + q.committer.Email,
+	}
+}
+
+func (q *LocalQuerier) git(env []string, stdin string, args ...string) (string, *localError) {
+	gitArgs := append([]string{"-C", q.option.Repo}, args...)
+	cmd := exec.Command("git", gitArgs...)
+	if q.ctx != nil {
+		cmd = exec.CommandContext(q.ctx, "git", gitArgs...)
+	}
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return "", &localError{Message: fmt.Sprintf("git %s: %s", args[0], msg)}
+	}
+	return stdout.String(), nil
+}
+
+func baseName(path string) string {
+	return path[strings.LastIndex(path, "/")+1:]
+}
+
+func (entry *localTreeEntry) transfer() *KeyRecord {
+	return &KeyRecord{
+		Name: baseName(entry.path),
+		Size: entry.size,
+		Sha:  entry.sha,
+		Path: entry.path,
+	}
+}
@@ -0,0 +1,121 @@
+package kv
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestLocalQuerier(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "freedb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if out, err := exec.Command("git", "init", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+
+	kv, err := NewKV("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.UseCache = false
+	kv.Use("golang")
+
+	record, err := kv.Set("key-exist", "123")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record.Commit) != 40 {
+		t.Errorf("expect a commit, got %s", record.Commit)
+	}
+	if record, _ = kv.Append("key-exist", "456"); record.Content != "123456" {
+		t.Errorf("expect 123456, got %s", record.Content)
+	}
+	if _, err = kv.Set("key-non-exist", "789"); err != nil {
+		t.Fatal(err)
+	}
+	if record, err = kv.Delete("key-non-exist"); err != nil || record.Name != "key-non-exist" {
+		t.Errorf("expect key-non-exist to be deleted: %v", err)
+	}
+	if record, _ = kv.Get("key-non-exist"); record.Name != "" {
+		t.Error("expect key-non-exist to be missing")
+	}
+	list, err := kv.Keys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*list) != 1 || (*list)[0].Name != "key-exist" || (*list)[0].Size != 6 {
+		t.Errorf("unexpected keys %v", *list)
+	}
+	batch, err := kv.Batch().Set("a", "1").Set("b", "2").Delete("key-exist").Exec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = kv.Keys(); len(*list) != 2 {
+		t.Errorf("expect 2 keys, got %v", *list)
+	}
+	out, err := exec.Command("git", "-C", dir, "rev-list", "--count", "master").Output()
+	if err != nil || string(out) != "5\n" {
+		t.Errorf("expect 5 commits, got %s", out)
+	}
+
+	a, _ := kv.Get("a")
+	if _, err = kv.SetIfNotExists("a", "4"); err == nil {
+		t.Error("expect SetIfNotExists to fail on an existing key")
+	}
+	if _, err = kv.Set("a", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kv.SetIfMatch("a", "6", a.Sha); err == nil {
+		t.Error("expect a conflict on a stale sha")
+	}
+	if _, err = kv.SetIfMatch("b", "7", batch.Commit); err != nil {
+		t.Errorf("expect b to be unchanged since %s, got %v", batch.Commit, err)
+	}
+
+	history, err := kv.History("a")
+	if err != nil || len(history) != 2 || history[1].Commit != batch.Commit {
+		t.Fatalf("unexpected history %v %v", history, err)
+	}
+	if history[0].Author != "freedb" || history[0].Date.IsZero() {
+		t.Errorf("unexpected revision %+v", history[0])
+	}
+	if record, _ = kv.GetAt("a", batch.Commit); record.Content != "1" {
+		t.Errorf("expect 1, got %s", record.Content)
+	}
+	if record, _ = kv.GetAt("key-exist", batch.Commit+"~1"); record.Content != "123456" {
+		t.Errorf("expect 123456, got %s", record.Content)
+	}
+
+	if _, err = kv.RestoreDatabase(batch.Commit + "~1"); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ = kv.Keys(); len(*list) != 1 || (*list)[0].Name != "key-exist" {
+		t.Errorf("expect key-exist only, got %v", *list)
+	}
+	if record, _ = kv.Revert("b", batch.Commit); record.Content != "2" {
+		t.Errorf("expect b to be reverted, got %v", record)
+	}
+
+	lq := kv.querier.(*LocalQuerier)
+	head, err := lq.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.Set("c", "3")
+	value := "4"
+	if _, err = lq.BatchOn([]*BatchOp{{Key: "c", Value: &value}}, head); !errors.Is(err, ErrConflict) {
+		t.Errorf("expect a batch on a stale head to conflict, got %v", err)
+	}
+	head, _ = lq.Head()
+	if record, err = lq.BatchOn([]*BatchOp{{Key: "c", Value: &value}}, head); err != nil || record.Commit == "" {
+		t.Errorf("expect a batch on the head, got %v %v", record, err)
+	}
+}
@@ -0,0 +1,121 @@
+package kv
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// shaMap holds the last known sha of every key, safe for concurrent use
+type shaMap struct {
+	mu sync.RWMutex
+	m  map[string]string
+}
+
+func newShaMap() *shaMap {
+	return &shaMap{m: make(map[string]string)}
+}
+
+func (s *shaMap) get(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sha, ok := s.m[key]
+	return sha, ok
+}
+
+func (s *shaMap) set(key string, sha string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.m[key] = sha
+}
+
+func (s *shaMap) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, key)
+}
+
+// keyLocks serializes the writes of a key, the lock of a key is dropped once
+// nobody holds or waits for it
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	// ch holds a value while the key is locked, so that waiting can be cancelled
+	ch chan struct{}
+	n  int
+}
+
+// lock locks every key, in order so that two writers never wait for each
+// other, and returns the function unlocking them
+func (l *keyLocks) lock(keys ...string) func() {
+	unlock, _ := l.lockContext(nil, keys...)
+	return unlock
+}
+
+// lockContext is lock, it gives up waiting with the error of ctx once ctx is
+// done and then holds no lock. A nil ctx waits forever.
+func (l *keyLocks) lockContext(ctx context.Context, keys ...string) (func(), error) {
+	unique := make(map[string]bool)
+	var sorted []string
+	for _, key := range keys {
+		if !unique[key] {
+			unique[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+
+	var held []*keyLock
+	unlock := func() {
+		for i, kl := range held {
+			<-kl.ch
+			l.drop(sorted[i], kl)
+		}
+	}
+	for _, key := range sorted {
+		l.mu.Lock()
+		if l.locks == nil {
+			l.locks = make(map[string]*keyLock)
+		}
+		kl, ok := l.locks[key]
+		if !ok {
+			kl = &keyLock{ch: make(chan struct{}, 1)}
+			l.locks[key] = kl
+		}
+		kl.n++
+		l.mu.Unlock()
+		// A free lock is taken even if ctx is done, only waiting is cancelled
+		select {
+		case kl.ch <- struct{}{}:
+			held = append(held, kl)
+			continue
+		default:
+		}
+		select {
+		case kl.ch <- struct{}{}:
+			held = append(held, kl)
+		case <-done:
+			l.drop(key, kl)
+			unlock()
+			return nil, ctx.Err()
+		}
+	}
+	return unlock, nil
+}
+
+// drop forgets the lock of a key once nobody holds or waits for it
+func (l *keyLocks) drop(key string, kl *keyLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kl.n--
+	if kl.n == 0 {
+		delete(l.locks, key)
+	}
+}
@@ -0,0 +1,158 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestKeyLocks(t *testing.T) {
+	var locks keyLocks
+	var wg sync.WaitGroup
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				// Locking in any order never deadlocks
+				a, b := "a", "b"
+				if (i+j)%2 == 0 {
+					a, b = b, a
+				}
+				unlock := locks.lock(a, b, a)
+				counts[a]++
+				counts[b]++
+				unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if counts["a"] != 800 || counts["b"] != 800 {
+		t.Errorf("expect 800 writes, got %v", counts)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("expect the locks to be dropped, got %d", len(locks.locks))
+	}
+}
+
+func TestKeyLocksContext(t *testing.T) {
+	var locks keyLocks
+	unlock := locks.lock("b")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// "a" is locked first and released when waiting for "b" is cancelled
+	if _, err := locks.lockContext(ctx, "a", "b"); err != context.Canceled {
+		t.Errorf("expect context.Canceled, got %v", err)
+	}
+	if unlockA, err := locks.lockContext(ctx, "a"); err != nil {
+		t.Errorf("expect a to be free, got %v", err)
+	} else {
+		unlockA()
+	}
+	unlock()
+	if len(locks.locks) != 0 {
+		t.Errorf("expect the locks to be dropped, got %d", len(locks.locks))
+	}
+}
+
+// testConcurrent appends to a shared key and writes its own key from several goroutines
+func testConcurrent(t *testing.T, kv *KV) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				if _, err := kv.Append("shared", "x"); err != nil {
+					t.Error(err)
+				}
+				key := fmt.Sprintf("key%d", i)
+				if _, err := kv.Set(key, fmt.Sprint(j)); err != nil {
+					t.Error(err)
+				}
+				if _, err := kv.Get(key); err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	kv.ClearCache()
+	if record, err := kv.Get("shared"); err != nil || record.Content != strings.Repeat("x", 20) {
+		t.Errorf("expect 20 appends, got %v %v", record, err)
+	}
+	for i := 0; i < 4; i++ {
+		if record, err := kv.Get(fmt.Sprintf("key%d", i)); err != nil || record.Content != "4" {
+			t.Errorf("expect key%d to be 4, got %v %v", i, record, err)
+		}
+	}
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	kv := NewKVWithQuerier(NewMemoryQuerier(nil, nil))
+	kv.SetSecret("secret")
+	testConcurrent(t, kv)
+}
+
+func TestLocalConcurrent(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "freedb-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if out, err := exec.Command("git", "init", "--bare", dir).CombinedOutput(); err != nil {
+		t.Fatal(string(out))
+	}
+	kv, err := NewKV("file://"+dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.UseCache = false
+	testConcurrent(t, kv)
+}
+
+func TestGithubConcurrent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("ETag", `"`+name+`"`)
+		if r.Header.Get("If-None-Match") == `"`+name+`"` {
+			w.WriteHeader(304)
+			return
+		}
+		fmt.Fprintf(w, `{"name": "%s", "sha": "%s", "content": ""}`, name, name)
+	}))
+	defer server.Close()
+
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(server.URL)
+	kv.SetCacheMode(CacheRevalidate)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				key := fmt.Sprintf("key%d", (i+j)%4)
+				if record, err := kv.Get(key); err != nil || record.Sha != key {
+					t.Errorf("expect %s, got %v %v", key, record, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,547 @@
+package kv
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory repository shared by MemoryQueriers.
+// Several queriers on the same store behave like several clients of one remote repository.
+type MemoryStore struct {
+	mu    sync.Mutex
+	files map[string]*memoryFile
+	log   []*memoryCommit
+}
+
+type memoryFile struct {
+	content string
+	sha     string
+	commit  string
+}
+
+// memoryCommit records the files a commit changed, a nil file is a deletion
+type memoryCommit struct {
+	revision *Revision
+	files    map[string]*memoryFile
+}
+
+// touched reports whether the commit changed the file at path, or a file in
+// the folder at path if it ends with "/"
+func (c *memoryCommit) touched(path string) bool {
+	if !strings.HasSuffix(path, "/") {
+		_, ok := c.files[path]
+		return ok
+	}
+	for p := range c.files {
+		if strings.HasPrefix(p, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryQuerier is a querier which keeps everything in memory.
+// It simulates the sha and commit values of a git repository, and answers a
+// stale sha with the same 409/422 conflicts github does, which makes it
+// suitable for unit tests and for embedding freedb without network access.
+type MemoryQuerier struct {
+	store    *MemoryStore
+	option   *QuerierOption
+	shaCache *shaMap
+	// ctx fails the queries of a copy made by WithContext once it is done, nil otherwise
+	ctx context.Context
+}
+
+type memoryError struct {
+	Message string
+	Code    int
+}
+
+func (e *memoryError) Error() string {
+	return fmt.Sprintf("[%d] %s", e.Code, e.Message)
+}
+
+// StatusCode is the http status github would answer with
+func (e *memoryError) StatusCode() int {
+	return e.Code
+}
+
+// Is reports whether the status matches a sentinel error, e.g. ErrNotFound
+func (e *memoryError) Is(target error) bool {
+	return statusIs(e.Code, target)
+}
+
+// NewMemoryStore is a store constructor
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		files: make(map[string]*memoryFile),
+	}
+}
+
+// NewMemoryQuerier is a querier constructor, a nil store creates a new one
+// and a nil option uses the same defaults as NewKV
+func NewMemoryQuerier(store *MemoryStore, option *QuerierOption) *MemoryQuerier {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+	if option == nil {
+		option = newQuerierOption()
+	}
+	return &MemoryQuerier{
+		store:    store,
+		option:   option,
+		shaCache: newShaMap(),
+	}
+}
+
+// Keys is a function to list all keys
+func (q *MemoryQuerier) Keys() (*[]*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	prefix := q.path("")
+	var names []string
+	for path := range q.store.files {
+		name := strings.TrimPrefix(path, prefix)
+		if name != path && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	krl := []*KeyRecord{}
+	for _, name := range names {
+		file := q.store.files[prefix+name]
+		q.shaCache.set(name, file.sha)
+		krl = append(krl, file.transfer(q.option.DB, name))
+	}
+	return &krl, nil
+}
+
+// Get is a function to read a key
+func (q *MemoryQuerier) Get(key string) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	file, ok := q.store.files[q.path(key)]
+	if !ok {
+		q.shaCache.remove(key)
+		return &KeyRecord{}, nil
+	}
+	q.shaCache.set(key, file.sha)
+	record := file.transfer(q.option.DB, key)
+	record.Content = file.content
+	return record, nil
+}
+
+// Set is a function to set a key
+func (q *MemoryQuerier) Set(key string, value string) (*KeyRecord, error) {
+	return q.set(key, value, false)
+}
+
+// set writes a key, a conflict is retried once with the current sha of the key
+func (q *MemoryQuerier) set(key string, value string, retried bool) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	record, err := q.put(key, &value)
+	if err != nil {
+		// Same as github, 409 means the sha is wrong, 422 means it is missing
+		if err.Code == 409 || err.Code == 422 {
+			if retried {
+				return nil, newError(ErrConflict, "Update key \"%s\" failed: %s", key, err)
+			}
+			_, getErr := q.Get(key) // Update sha for the key
+			if getErr != nil {
+				return nil, fmt.Errorf("Get key \"%s\" failed: %w", key, getErr)
+			}
+			return q.set(key, value, true)
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// SetIfMatch is a function to set a key only if it still matches expected,
+// which is the sha of the key or a commit since which the key is unchanged
+func (q *MemoryQuerier) SetIfMatch(key string, value string, expected string) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	file, exist := q.store.files[q.path(key)]
+	matched := q.match(file, key, expected)
+	q.store.mu.Unlock()
+
+	if !matched {
+		return nil, &ConflictError{Key: key, Expected: expected}
+	}
+	if exist {
+		q.shaCache.set(key, file.sha)
+	} else {
+		q.shaCache.remove(key)
+	}
+	record, err := q.put(key, &value)
+	if err != nil {
+		// Someone else wrote the key in the meantime
+		if err.Code == 409 || err.Code == 422 {
+			return nil, &ConflictError{Key: key, Expected: expected}
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// match reports whether the current file of a key matches expected, like
+// LocalQuerier it compares the content at a commit. The caller must hold the store lock.
+func (q *MemoryQuerier) match(file *memoryFile, key string, expected string) bool {
+	if expected == "" || file == nil {
+		return expected == "" && file == nil
+	}
+	if file.sha == expected || file.commit == expected {
+		return true
+	}
+	files, err := q.filesAt(expected)
+	if err != nil {
+		return false
+	}
+	past, ok := files[q.path(key)]
+	return ok && past.sha == file.sha
+}
+
+// Delete is a function to delete a key
+func (q *MemoryQuerier) Delete(key string) (*KeyRecord, error) {
+	return q.delete(key, false)
+}
+
+// delete removes a key, a conflict is retried once with the current sha of the key
+func (q *MemoryQuerier) delete(key string, retried bool) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	record, err := q.put(key, nil)
+	if err != nil {
+		if err.Code == 409 || err.Code == 422 {
+			if retried {
+				return nil, newError(ErrConflict, "Update key \"%s\" failed: %s", key, err)
+			}
+			getKr, getErr := q.Get(key) // Update sha for the key
+			if getErr != nil {
+				return nil, fmt.Errorf("Get key \"%s\" failed: %w", key, getErr)
+			}
+			if getKr.Name == "" { // The key do not exist, can not delete it
+				return &KeyRecord{}, nil
+			}
+			return q.delete(key, true)
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// Batch is a function to write several keys in one commit
+func (q *MemoryQuerier) Batch(ops []*BatchOp) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.batch(ops), nil
+}
+
+// Head is a function to get the last commit of the store
+func (q *MemoryQuerier) Head() (string, error) {
+	if err := q.done(); err != nil {
+		return "", err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	return q.head(), nil
+}
+
+// BatchOn is a function to write several keys in one commit if no commit was
+// made since head
+func (q *MemoryQuerier) BatchOn(ops []*BatchOp, head string) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+	if q.head() != head {
+		return nil, &memoryError{Code: 409, Message: fmt.Sprintf("The store has changed since %s", head)}
+	}
+	return q.batch(ops), nil
+}
+
+// head returns the last commit, the caller must hold the store lock
+func (q *MemoryQuerier) head() string {
+	if len(q.store.log) == 0 {
+		return ""
+	}
+	return q.store.log[len(q.store.log)-1].revision.Commit
+}
+
+// batch commits ops, the caller must hold the store lock
+func (q *MemoryQuerier) batch(ops []*BatchOp) *KeyRecord {
+	values := make(map[string]*string)
+	for _, op := range ops {
+		if op.Value == nil {
+			q.shaCache.remove(op.Key)
+			if _, ok := q.store.files[q.path(op.Key)]; !ok {
+				continue
+			}
+		}
+		values[q.path(op.Key)] = op.Value
+	}
+	commit := q.commit(fmt.Sprintf("freedb update %d keys from golang client", len(ops)), values)
+	for _, op := range ops {
+		if op.Value != nil {
+			q.shaCache.set(op.Key, q.store.files[q.path(op.Key)].sha)
+		}
+	}
+	return &KeyRecord{Commit: commit}
+}
+
+// History is a function to list the commits which touched a key
+func (q *MemoryQuerier) History(key string) ([]*Revision, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	path := q.path(key)
+	history := []*Revision{}
+	for i := len(q.store.log) - 1; i >= 0; i-- {
+		c := q.store.log[i]
+		if c.touched(path) {
+			revision := *c.revision
+			history = append(history, &revision)
+		}
+	}
+	return history, nil
+}
+
+// GetAt is a function to read a key at a commit
+func (q *MemoryQuerier) GetAt(key string, ref string) (*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	files, err := q.filesAt(ref)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := files[q.path(key)]
+	if !ok {
+		return &KeyRecord{}, nil
+	}
+	record := file.transfer(q.option.DB, key)
+	record.Content = file.content
+	return record, nil
+}
+
+// KeysAt is a function to list all keys at a commit
+func (q *MemoryQuerier) KeysAt(ref string) (*[]*KeyRecord, error) {
+	if err := q.done(); err != nil {
+		return nil, err
+	}
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	files, err := q.filesAt(ref)
+	if err != nil {
+		return nil, err
+	}
+	prefix := q.path("")
+	var names []string
+	for path := range files {
+		name := strings.TrimPrefix(path, prefix)
+		if name != path && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	krl := []*KeyRecord{}
+	for _, name := range names {
+		krl = append(krl, files[prefix+name].transfer(q.option.DB, name))
+	}
+	return &krl, nil
+}
+
+// filesAt replays the log up to ref, which is a commit or the branch.
+// The caller must hold the store lock.
+func (q *MemoryQuerier) filesAt(ref string) (map[string]*memoryFile, *memoryError) {
+	if ref == q.option.Branch {
+		return q.store.files, nil
+	}
+	files := make(map[string]*memoryFile)
+	for _, c := range q.store.log {
+		for path, file := range c.files {
+			if file == nil {
+				delete(files, path)
+			} else {
+				files[path] = file
+			}
+		}
+		if c.revision.Commit == ref {
+			return files, nil
+		}
+	}
+	return nil, &memoryError{Code: 404, Message: fmt.Sprintf("Revision \"%s\" not found", ref)}
+}
+
+// SetHost is a function to update the repository
+func (q *MemoryQuerier) SetHost(user, repo string) {
+	q.option.User = user
+	q.option.Repo = repo
+}
+
+// SetAPIURL is a function to update the API base URL
+func (q *MemoryQuerier) SetAPIURL(apiURL string) {
+	q.option.APIURL = apiURL
+}
+
+// SetBranch is a function to update the branch
+func (q *MemoryQuerier) SetBranch(branch string) {
+	q.option.Branch = branch
+}
+
+// Use is a function to change database
+func (q *MemoryQuerier) Use(db string) {
+	q.option.DB = db
+}
+
+// SetToken is a function to update the token
+func (q *MemoryQuerier) SetToken(token string) {
+	q.option.Token = token
+}
+
+// Option is a function to get the current option
+func (q *MemoryQuerier) Option() *QuerierOption {
+	return q.option
+}
+
+// WithContext is a function to get a copy of the querier whose queries fail once ctx is done
+func (q *MemoryQuerier) WithContext(ctx context.Context) Querier {
+	c := *q
+	c.ctx = ctx
+	return &c
+}
+
+// done returns the error of the context of the querier, if it is done
+func (q *MemoryQuerier) done() error {
+	if q.ctx == nil {
+		return nil
+	}
+	return q.ctx.Err()
+}
+
+func (q *MemoryQuerier) path(key string) string {
+	return strings.Join([]string{q.option.User, q.option.Repo, q.option.Branch, q.option.DB, key}, "/")
+}
+
+// put writes a key like the github contents API does, a nil value deletes the key
+func (q *MemoryQuerier) put(key string, value *string) (*KeyRecord, *memoryError) {
+	q.store.mu.Lock()
+	defer q.store.mu.Unlock()
+
+	path := q.path(key)
+	file, exist := q.store.files[path]
+	sha, ok := q.shaCache.get(key)
+	if !ok && exist {
+		return nil, &memoryError{Code: 422, Message: "\"sha\" wasn't supplied."}
+	}
+	if ok && (!exist || file.sha != sha) {
+		return nil, &memoryError{Code: 409, Message: fmt.Sprintf("%s does not match %s", key, sha)}
+	}
+	if value == nil && !exist {
+		return &KeyRecord{}, nil
+	}
+
+	if value == nil {
+		commit := q.commit("freedb delete a key from golang client", map[string]*string{path: nil})
+		q.shaCache.remove(key)
+		return &KeyRecord{Name: baseName(key), Commit: commit}, nil
+	}
+	message := "freedb update a key from golang client"
+	if !exist {
+		message = "freedb create a key from golang client"
+	}
+	q.commit(message, map[string]*string{path: value})
+	file = q.store.files[path]
+	q.shaCache.set(key, file.sha)
+	return file.transfer(q.option.DB, key), nil
+}
+
+// commit applies values to the store as a new commit, a nil value deletes the file.
+// The caller must hold the store lock.
+func (q *MemoryQuerier) commit(message string, values map[string]*string) string {
+	var paths []string
+	for path := range values {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	commit := hashObject("commit", fmt.Sprintf("%s\n%d\n%s", strings.Join(paths, "\n"), len(q.store.log), message))
+	c := &memoryCommit{
+		revision: &Revision{
+			Commit:  commit,
+			Date:    time.Now(),
+			Message: message,
+		},
+		files: make(map[string]*memoryFile),
+	}
+	if q.option.Committer != nil {
+		c.revision.Author = q.option.Committer.Name
+		c.revision.Email = q.option.Committer.Email
+	}
+	for _, path := range paths {
+		value := values[path]
+		if value == nil {
+			delete(q.store.files, path)
+			c.files[path] = nil
+			continue
+		}
+		file := &memoryFile{
+			content: *value,
+			sha:     hashObject("blob", *value),
+			commit:  commit,
+		}
+		q.store.files[path] = file
+		c.files[path] = file
+	}
+	q.store.log = append(q.store.log, c)
+	return commit
+}
+
+// hashObject computes the same object id as "git hash-object -t <kind>"
+func hashObject(kind string, content string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00%s", kind, len(content), content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (file *memoryFile) transfer(db string, key string) *KeyRecord {
+	return &KeyRecord{
+		Path:   db + "/" + key,
+		Name:   baseName(key),
+		Size:   len(file.content),
+		Sha:    file.sha,
+		Commit: file.commit,
+	}
+}
@@ -1,6 +1,9 @@
 package kv
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"net/http"
+)
 
 // KeyRecord is the record for a key
 type KeyRecord struct {
@@ -9,30 +12,63 @@ type KeyRecord struct {
 	Size    int    `json:"size,omitempty"`
 	RawURL  string `json:"raw_url,omitempty"`
 	HTMLURL string `json:"html_url,omitempty"`
-	Commit  string `json:"commit,omitempty"`
+	// Sha is the git blob sha of the content
+	Sha    string `json:"sha,omitempty"`
+	Commit string `json:"commit,omitempty"`
+	// Path is where the key is stored in the repository, e.g. "default/<encrypted name>"
+	Path string `json:"path,omitempty"`
+	// Undecryptable is set by KV.Keys on a name the secret can not decrypt
+	Undecryptable bool `json:"undecryptable,omitempty"`
+	// Pending is set on a write kept in the journal until the next KV.Sync
+	Pending bool `json:"pending,omitempty"`
 }
 
-// Querier is a interface that to query github
+// Querier is a interface that to query a git repository.
+// Keys live in the DB folder of the Branch, as one file per key.
+// Implement it and call RegisterQuerier to add a new backend. Queries must be
+// safe for concurrent use, the setters are not called concurrently with them.
 type Querier interface {
 	Get(key string) (*KeyRecord, error)
 	Set(key string, value string) (*KeyRecord, error)
 	Delete(key string) (*KeyRecord, error)
 	Keys() (*[]*KeyRecord, error)
 
-	setHost(user, repo string)
-	setBranch(branch string)
-	use(db string)
-	setToken(token string)
+	SetHost(user, repo string)
+	SetAPIURL(apiURL string)
+	SetBranch(branch string)
+	Use(db string)
+	SetToken(token string)
+	Option() *QuerierOption
 }
 
+// QuerierConstructor creates a Querier from an option
+type QuerierConstructor func(option *QuerierOption) Querier
+
 // QuerierOption is an option pass to Querier constructor
 type QuerierOption struct {
-	user      string
-	repo      string
-	db        string
-	token     string
-	branch    string
-	committer *Committer
+	// Host is the provider parsed from the git link, e.g. github.com
+	Host string
+	// APIURL is the API base URL, empty means the querier's default
+	APIURL    string
+	User      string
+	Repo      string
+	DB        string
+	Token     string
+	Branch    string
+	Committer *Committer
+	// HTTPClient sends the requests of the http queriers, nil means http.DefaultClient.
+	// Set it for timeouts, proxies, custom CAs or a test server.
+	HTTPClient *http.Client
+	// Retry is how the http queriers retry rate limited and failed requests, nil means DefaultRetryPolicy
+	Retry *RetryPolicy
+}
+
+// client returns the http client of the option
+func (o *QuerierOption) client() *http.Client {
+	if o.HTTPClient != nil {
+		return o.HTTPClient
+	}
+	return http.DefaultClient
 }
 
 // Committer is a git comitter type
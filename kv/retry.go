@@ -0,0 +1,205 @@
+package kv
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is how the http queriers retry a request which was rate limited
+// or failed with a 5xx error. Requests which never reached the host are not retried.
+type RetryPolicy struct {
+	// MaxRetries is the number of retries of a request, 0 never retries
+	MaxRetries int
+	// MinBackoff is the wait before the first retry of a 5xx error,
+	// it doubles on every retry up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxWait is the longest wait for Retry-After or a rate limit reset,
+	// a request which has to wait longer fails at once
+	MaxWait time.Duration
+}
+
+// DefaultRetryPolicy is the policy of the queriers whose option has no Retry
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxRetries: 3,
+	MinBackoff: 500 * time.Millisecond,
+	MaxBackoff: 10 * time.Second,
+	MaxWait:    time.Minute,
+}
+
+// RateLimit is the request quota of the token on the host
+type RateLimit struct {
+	// Limit is the number of requests per window, 0 when the host reports no rate limit
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+	// Reset is when the quota is renewed
+	Reset time.Time `json:"reset"`
+}
+
+// RateLimitQuerier is implemented by queriers which report the rate limit of the host
+type RateLimitQuerier interface {
+	// RateLimit returns the quota reported by the last response, the host is
+	// queried if no request was sent yet
+	RateLimit() (*RateLimit, error)
+}
+
+// rateLimits keeps the rate limit reported by the last response
+type rateLimits struct {
+	mu   sync.Mutex
+	last *RateLimit
+}
+
+func (r *rateLimits) update(header http.Header) {
+	limit, err := strconv.Atoi(rateHeader(header, "Limit"))
+	if err != nil {
+		return
+	}
+	remaining, _ := strconv.Atoi(rateHeader(header, "Remaining"))
+	rl := &RateLimit{Limit: limit, Remaining: remaining}
+	if reset, err := strconv.ParseInt(rateHeader(header, "Reset"), 10, 64); err == nil {
+		rl.Reset = time.Unix(reset, 0)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last = rl
+}
+
+// get returns a copy of the last rate limit, and whether one was reported
+func (r *rateLimits) get() (*RateLimit, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.last == nil {
+		return &RateLimit{}, false
+	}
+	rl := *r.last
+	return &rl, true
+}
+
+// rateHeader reads a rate limit header, github and gitea send X-RateLimit-*
+// and gitlab RateLimit-*
+func rateHeader(header http.Header, name string) string {
+	if value := header.Get("X-RateLimit-" + name); value != "" {
+		return value
+	}
+	return header.Get("RateLimit-" + name)
+}
+
+// retryAfter returns the wait a rate limited response asks for
+func retryAfter(header http.Header, now time.Time) (time.Duration, bool) {
+	var wait time.Duration
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil {
+			wait = time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(value); err == nil {
+			wait = date.Sub(now)
+		} else {
+			return 0, false
+		}
+	} else if reset, err := strconv.ParseInt(rateHeader(header, "Reset"), 10, 64); err == nil && rateHeader(header, "Remaining") == "0" {
+		wait = time.Unix(reset, 0).Sub(now)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
+
+// rateLimited reports whether a response was rejected by the rate limit,
+// github answers an exhausted quota with 403 too
+func rateLimited(resp *http.Response) bool {
+	return resp.StatusCode == 429 ||
+		resp.StatusCode == 403 && (resp.Header.Get("Retry-After") != "" || rateHeader(resp.Header, "Remaining") == "0")
+}
+
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.MinBackoff << uint(attempt)
+	if wait > p.MaxBackoff || wait < p.MinBackoff {
+		wait = p.MaxBackoff
+	}
+	return wait
+}
+
+// wait returns how long to wait before retrying a response, false if it is not retried
+func (p *RetryPolicy) wait(resp *http.Response, attempt int, now time.Time) (time.Duration, bool) {
+	if attempt >= p.MaxRetries {
+		return 0, false
+	}
+	switch {
+	case rateLimited(resp):
+		wait, ok := retryAfter(resp.Header, now)
+		if !ok {
+			wait = p.backoff(attempt)
+		}
+		return wait, wait <= p.MaxWait
+	case resp.StatusCode == 500, resp.StatusCode == 502, resp.StatusCode == 503, resp.StatusCode == 504:
+		if wait, ok := retryAfter(resp.Header, now); ok {
+			return wait, wait <= p.MaxWait
+		}
+		return p.backoff(attempt), true
+	}
+	return 0, false
+}
+
+// send sends a request with the http client and the retry policy of the
+// option, the rate limit of every response is kept in limits
+func (o *QuerierOption) send(req *http.Request, limits *rateLimits) (*http.Response, error) {
+	policy := o.Retry
+	if policy == nil {
+		policy = DefaultRetryPolicy
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := o.client().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		limits.update(resp.Header)
+		wait, retry := policy.wait(resp, attempt, time.Now())
+		// A body which can not be sent again is not retried
+		if !retry || req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		req = req.WithContext(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		if err := sleep(req.Context(), wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// sleep waits for d, or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SetRetryPolicy is a function to change how rate limited and failed requests
+// are retried, nil uses DefaultRetryPolicy again
+func (kv *KV) SetRetryPolicy(policy *RetryPolicy) {
+	kv.querier.Option().Retry = policy
+}
+
+// RateLimit is the function to get the request quota of the token on the host
+func (kv *KV) RateLimit() (*RateLimit, error) {
+	rq, ok := kv.querier.(RateLimitQuerier)
+	if !ok {
+		return nil, fmt.Errorf("%T does not report rate limits", kv.querier)
+	}
+	return rq.RateLimit()
+}
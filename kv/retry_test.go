@@ -0,0 +1,103 @@
+package kv
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyWait(t *testing.T) {
+	policy := &RetryPolicy{MaxRetries: 3, MinBackoff: time.Second, MaxBackoff: 3 * time.Second, MaxWait: time.Minute}
+	now := time.Unix(1000, 0)
+	tests := []struct {
+		status  int
+		header  map[string]string
+		attempt int
+		wait    time.Duration
+		retry   bool
+	}{
+		{500, nil, 0, time.Second, true},
+		{502, nil, 1, 2 * time.Second, true},
+		{503, nil, 2, 3 * time.Second, true},
+		{503, nil, 3, 0, false},
+		{404, nil, 0, 0, false},
+		// A 403 which is not a rate limit is not retried
+		{403, map[string]string{"X-RateLimit-Remaining": "10"}, 0, 0, false},
+		{403, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "1030"}, 0, 30 * time.Second, true},
+		{403, map[string]string{"Retry-After": "5"}, 0, 5 * time.Second, true},
+		{429, map[string]string{"Retry-After": "5"}, 0, 5 * time.Second, true},
+		{429, map[string]string{"RateLimit-Remaining": "0", "RateLimit-Reset": "990"}, 0, 0, true},
+		{429, nil, 1, 2 * time.Second, true},
+		// Too long a wait fails at once
+		{429, map[string]string{"Retry-After": "3600"}, 0, time.Hour, false},
+	}
+	for _, test := range tests {
+		resp := &http.Response{StatusCode: test.status, Header: make(http.Header)}
+		for name, value := range test.header {
+			resp.Header.Set(name, value)
+		}
+		wait, retry := policy.wait(resp, test.attempt, now)
+		if wait != test.wait || retry != test.retry {
+			t.Errorf("%d %v: expect %v %v, got %v %v", test.status, test.header, test.wait, test.retry, wait, retry)
+		}
+	}
+}
+
+func TestGithubRetry(t *testing.T) {
+	var n int
+	reset := time.Now().Add(time.Hour).Unix()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(5000-n))
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		switch r.URL.Path {
+		case "/repos/Gcaufy-Test/test-database/contents/default/flaky":
+			if n < 3 {
+				w.WriteHeader(502)
+				return
+			}
+			fmt.Fprintf(w, `{"name": "flaky", "content": "%s"}`, base64.StdEncoding.EncodeToString([]byte("1")))
+		case "/repos/Gcaufy-Test/test-database/contents/default/limited":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(429)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer server.Close()
+
+	kv, err := NewKV("git@github.com:Gcaufy-Test/test-database.git", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv.SetAPIURL(server.URL)
+	kv.SetRetryPolicy(&RetryPolicy{MaxRetries: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxWait: time.Second})
+	if record, err := kv.Get("flaky"); err != nil || record.Content != "1" {
+		t.Fatalf("expect 1 after 2 retries, got %v %v", record, err)
+	}
+	if n != 3 {
+		t.Errorf("expect 3 requests, got %d", n)
+	}
+	if _, err := kv.Get("limited"); err == nil {
+		t.Error("expect a rate limit error")
+	}
+	if n != 4 {
+		t.Errorf("expect a rate limit longer than MaxWait not to be retried, got %d requests", n-3)
+	}
+
+	rl, err := kv.RateLimit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rl.Limit != 5000 || rl.Remaining != 4996 || rl.Reset.Unix() != reset {
+		t.Errorf("expect 4996/5000, got %v", rl)
+	}
+	if _, err := NewKVWithQuerier(NewMemoryQuerier(nil, nil)).RateLimit(); err == nil {
+		t.Error("expect the memory querier not to report rate limits")
+	}
+}
@@ -0,0 +1,115 @@
+package kv
+
+import (
+	"fmt"
+	"time"
+)
+
+// Revert is the function to write a key back to its value at rev, which is
+// anything GetAt accepts. The old value is written as a new commit, and a key
+// missing at rev is deleted.
+func (kv *KV) Revert(key string, rev string) (*KeyRecord, error) {
+	unlock, err := kv.lock(kv.cacheKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	record, err := kv.GetAt(key, rev)
+	if err != nil {
+		return nil, err
+	}
+	if record.Name == "" {
+		return kv.delete(key)
+	}
+	return kv.set(key, record.Content)
+}
+
+// RestoreDatabase is the function to write the whole database back to its
+// state at rev, which is anything GetAt accepts. Keys are restored and keys
+// created since are deleted, all in a single new commit. The metadata is
+// restored with them, so that the keys decrypt with the salt they were
+// written with. The record holds the commit, it is empty if the database did
+// not change since rev. If the querier is a HeadBatchQuerier, nothing is
+// written when the branch moved while the keys were read, and the error
+// matches ErrConflict.
+func (kv *KV) RestoreDatabase(rev string) (*KeyRecord, error) {
+	hq, err := kv.historyQuerier()
+	if err != nil {
+		return nil, err
+	}
+	bq, ok := kv.querier.(BatchQuerier)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support batch writes", kv.querier)
+	}
+	if t, ok := parseTime(rev); ok {
+		if rev, err = commitAt(hq, "", t); err != nil {
+			return nil, err
+		}
+		// Restoring an empty database would delete every key
+		if rev == "" {
+			return nil, newError(ErrNotFound, "The database has no commit before %s", t.Format(time.RFC3339))
+		}
+	}
+
+	hbq, pinned := bq.(HeadBatchQuerier)
+	var head string
+	if pinned {
+		if head, err = hbq.Head(); err != nil {
+			return nil, err
+		}
+	}
+
+	past, err := hq.KeysAt(rev)
+	if err != nil {
+		return nil, err
+	}
+	current, err := kv.querier.Keys()
+	if err != nil {
+		return nil, err
+	}
+	currentSha := make(map[string]string)
+	for _, kr := range *current {
+		currentSha[kr.Name] = kr.Sha
+	}
+
+	// Names and values are copied as stored, so they need no encryption
+	var ops []*BatchOp
+	for _, kr := range *past {
+		sha, exist := currentSha[kr.Name]
+		delete(currentSha, kr.Name)
+		if exist && sha != "" && sha == kr.Sha {
+			continue
+		}
+		record, err := hq.GetAt(kr.Name, rev)
+		if err != nil {
+			return nil, err
+		}
+		value := record.Content
+		ops = append(ops, &BatchOp{Key: kr.Name, Value: &value})
+	}
+	for name := range currentSha {
+		ops = append(ops, &BatchOp{Key: name})
+	}
+	if len(ops) == 0 {
+		return &KeyRecord{}, nil
+	}
+
+	var record *KeyRecord
+	if pinned {
+		record, err = hbq.BatchOn(ops, head)
+	} else {
+		record, err = bq.Batch(ops)
+	}
+	if kv.disk != nil {
+		kv.disk.clear(kv.location())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The data key may have changed with the metadata
+	kv.resetDerived()
+	if kv.UseCache {
+		kv.ClearCache()
+	}
+	return record, nil
+}
@@ -0,0 +1,170 @@
+package kv
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Rotation is the result of RotateSecret
+type Rotation struct {
+	// Keys are the names of the re-encrypted keys
+	Keys   []string `json:"keys"`
+	Commit string   `json:"commit,omitempty"`
+	DryRun bool     `json:"dry_run,omitempty"`
+}
+
+// rotationKey is a key read with the old secret
+type rotationKey struct {
+	name  string
+	value string
+	// stored are the names the key is stored under, one per format
+	stored []string
+	// rank is the position of the freshest stored name in storedNames
+	rank int
+}
+
+// RotateSecret is the function to re-encrypt every key name and value of the
+// current database with newSecret, in a single commit which also writes a new
+// salt. Every key is decrypted with oldSecret first, nothing is written if one
+// of them fails. With dryRun, it only verifies and lists the keys. If the
+// querier is a HeadBatchQuerier, nothing is written either when the branch
+// moved while the keys were read, and the error matches ErrConflict, so that a
+// key written meanwhile is not left encrypted with the old secret.
+func (kv *KV) RotateSecret(oldSecret string, newSecret string, dryRun bool) (*Rotation, error) {
+	bq, ok := kv.querier.(BatchQuerier)
+	if !ok {
+		return nil, fmt.Errorf("%T does not support batch writes", kv.querier)
+	}
+	if len(kv.providers) > 0 {
+		return nil, fmt.Errorf("The data key of key providers is changed with RewrapDataKey")
+	}
+	if oldSecret == "" || newSecret == "" {
+		return nil, fmt.Errorf("Both the old and the new secret are required")
+	}
+
+	hq, pinned := bq.(HeadBatchQuerier)
+	var head string
+	if pinned {
+		var err error
+		if head, err = hq.Head(); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := kv.readWithSecret(oldSecret)
+	if err != nil {
+		return nil, err
+	}
+	rotation := &Rotation{Keys: []string{}, DryRun: dryRun}
+	for _, key := range keys {
+		rotation.Keys = append(rotation.Keys, key.name)
+	}
+	if dryRun {
+		return rotation, nil
+	}
+
+	m, err := newMetadata()
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := m.deriveKey(newSecret)
+	if err != nil {
+		return nil, err
+	}
+	content, _ := json.MarshalIndent(m, "", "  ")
+	metadataContent := string(content)
+	ops := []*BatchOp{{Key: metadataFile, Value: &metadataContent}}
+	for _, key := range keys {
+		for _, name := range key.stored {
+			ops = append(ops, &BatchOp{Key: name})
+		}
+		name := encryptName(key.name, newKey)
+		value, err := encrypt(key.value, newKey, name)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, &BatchOp{Key: name, Value: &value})
+	}
+
+	var record *KeyRecord
+	if pinned {
+		record, err = hq.BatchOn(ops, head)
+	} else {
+		record, err = bq.Batch(ops)
+	}
+	if kv.disk != nil {
+		kv.disk.clear(kv.location())
+	}
+	if err != nil {
+		return nil, err
+	}
+	kv.SetSecret(newSecret)
+	if kv.UseCache {
+		kv.ClearCache()
+	}
+	kv.setDerived(kv.location(), &keyring{data: newKey})
+	rotation.Commit = record.Commit
+	return rotation, nil
+}
+
+// readWithSecret decrypts every key of the current database with secret,
+// it fails on the first stored name or value secret can not decrypt
+func (kv *KV) readWithSecret(secret string) ([]*rotationKey, error) {
+	// UseCache only remembers the missing metadata, old never reads the cache
+	old := &KV{
+		querier:  kv.querier,
+		secret:   secret,
+		derived:  make(map[string]*keyring),
+		mu:       &sync.Mutex{},
+		locks:    &keyLocks{},
+		UseCache: true,
+	}
+	ring, err := old.cipherKeys(false)
+	if err != nil {
+		return nil, err
+	}
+	krl, err := kv.querier.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*rotationKey)
+	for _, kr := range *krl {
+		if kr.Name == metadataFile {
+			continue
+		}
+		name, rank, err := old.decryptName(kr.Name, ring)
+		if err != nil {
+			return nil, fmt.Errorf("Key \"%s\" can not be decrypted with the old secret", kr.Name)
+		}
+
+		key, ok := byName[name]
+		if !ok {
+			key = &rotationKey{name: name, rank: len(ring.names(name))}
+			byName[name] = key
+		}
+		key.stored = append(key.stored, kr.Name)
+		if rank >= key.rank {
+			continue
+		}
+		// Reading prefers the freshest format, so does the rotation
+		record, err := kv.querier.Get(kr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if key.value, err = old.decryptValue(name, kr.Name, record.Content); err != nil {
+			return nil, err
+		}
+		key.rank = rank
+	}
+
+	var keys []*rotationKey
+	for _, key := range byName {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].name < keys[j].name
+	})
+	return keys, nil
+}
@@ -0,0 +1,377 @@
+package kv
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// metadataFile is stored in the database folder next to the keys, it holds
+// the salt the secret is derived with. It is hidden from the key list.
+const metadataFile = ".freedb.json"
+
+// metadata describes how the AES key of a database is derived from the
+// secret, or with KDF "envelope", holds the data key wrapped for every recipient
+type metadata struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"`
+	Salt    string `json:"salt,omitempty"`
+	N       int    `json:"n,omitempty"`
+	R       int    `json:"r,omitempty"`
+	P       int    `json:"p,omitempty"`
+	// Recipients are the wrapped data keys by recipient id
+	Recipients map[string]string `json:"recipients,omitempty"`
+	// Legacy is set when the metadata was added to a database which already
+	// had keys, written by older versions with the MD5 of the secret
+	Legacy bool `json:"legacy,omitempty"`
+}
+
+// keyring holds the AES keys of a database
+type keyring struct {
+	// data is derived with the metadata or unwrapped from it, it seals names
+	// and values with AES-GCM. It is empty if the database has no metadata.
+	data string
+	// legacy is the truncated MD5 of the secret older versions used with
+	// AES-CBC, it is empty if the database has no keys written by them
+	legacy string
+}
+
+// names returns the names a key may be stored under, the first one is the name to write
+func (r *keyring) names(key string) []string {
+	var names []string
+	if r.data != "" {
+		names = append(names, encryptName(key, r.data))
+	}
+	if r.legacy != "" {
+		names = append(names, legacyEncrypt(key, r.legacy))
+	}
+	return names
+}
+
+// seal encrypts a value stored under name with the data key, the value
+// does not open under another name
+func (r *keyring) seal(name string, value string) (string, error) {
+	return encrypt(value, r.data, name)
+}
+
+// open decrypts a value stored under name with the data key, or with the
+// legacy key if the database has keys written by older versions
+func (r *keyring) open(name string, value string) (string, error) {
+	err := errDecrypt
+	if r.data != "" {
+		plain, openErr := decrypt(value, r.data, name)
+		if openErr == nil || r.legacy == "" {
+			return plain, openErr
+		}
+		err = openErr
+	}
+	if r.legacy != "" {
+		return legacyDecrypt(value, r.legacy)
+	}
+	return "", err
+}
+
+func newMetadata() (*metadata, error) {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return &metadata{
+		Version: 1,
+		KDF:     "scrypt",
+		Salt:    base64.StdEncoding.EncodeToString(salt),
+		N:       32768,
+		R:       8,
+		P:       1,
+	}, nil
+}
+
+// newEnvelopeMetadata creates a random data key and wraps it with every provider
+func newEnvelopeMetadata(providers []KeyProvider) (*metadata, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+	m := &metadata{Version: 1, KDF: "envelope"}
+	if err := m.wrap(dataKey, providers); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// wrap replaces the recipients with the ones of providers
+func (m *metadata) wrap(dataKey []byte, providers []KeyProvider) error {
+	m.Recipients = make(map[string]string)
+	for _, provider := range providers {
+		wrapped, err := provider.Wrap(dataKey)
+		if err != nil {
+			return err
+		}
+		for id, key := range wrapped {
+			// Overwriting a recipient would lock it out of the database
+			if _, ok := m.Recipients[id]; ok {
+				return fmt.Errorf("The data key is wrapped twice for \"%s\"", id)
+			}
+			m.Recipients[id] = key
+		}
+	}
+	return nil
+}
+
+// unwrap recovers the data key with the first provider which can
+func (m *metadata) unwrap(providers []KeyProvider) ([]byte, error) {
+	var err error
+	for _, provider := range providers {
+		dataKey, unwrapErr := provider.Unwrap(m.Recipients)
+		if unwrapErr == nil {
+			return dataKey, nil
+		}
+		err = unwrapErr
+	}
+	return nil, fmt.Errorf("No key provider can unwrap the data key: %s", err)
+}
+
+// deriveKey returns a 32 bytes AES key, which selects AES-256
+func (m *metadata) deriveKey(secret string) (string, error) {
+	if m.KDF != "scrypt" {
+		return "", fmt.Errorf("Unknown key derivation function \"%s\"", m.KDF)
+	}
+	salt, err := base64.StdEncoding.DecodeString(m.Salt)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(secret), salt, m.N, m.R, m.P, 32)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// location identifies the database the derived key belongs to
+func (kv *KV) location() string {
+	op := kv.querier.Option()
+	return strings.Join([]string{op.Host, op.User, op.Repo, op.Branch, op.DB}, "/")
+}
+
+// encrypted reports whether keys are encrypted, with a secret or key providers
+func (kv *KV) encrypted() bool {
+	return kv.secret != "" || len(kv.providers) > 0
+}
+
+// cipherKeys returns the AES keys of the current database. Databases written
+// by older versions have no metadata and only a legacy key, the truncated MD5
+// of the secret. With write, the metadata is created if the database has none.
+func (kv *KV) cipherKeys(write bool) (*keyring, error) {
+	loc := kv.location()
+	if ring, ok := kv.derivedKey(loc); ok && (ring.data != "" || !write) {
+		return ring, nil
+	}
+
+	m, err := kv.readMetadata()
+	if err != nil {
+		return nil, err
+	}
+	if m == nil && !write {
+		ring := &keyring{legacy: kv.legacyKey()}
+		// Remember the database has no metadata until the cache is cleared
+		if kv.UseCache {
+			kv.setDerived(loc, ring)
+		}
+		return ring, nil
+	}
+	if m == nil {
+		if m, err = kv.createMetadata(); err != nil {
+			return nil, err
+		}
+	}
+	key, err := kv.dataKey(m)
+	if err != nil {
+		return nil, err
+	}
+	ring := &keyring{data: key}
+	if m.Legacy {
+		ring.legacy = kv.legacyKey()
+	}
+	kv.setDerived(loc, ring)
+	return ring, nil
+}
+
+func (kv *KV) derivedKey(loc string) (*keyring, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	ring, ok := kv.derived[loc]
+	return ring, ok
+}
+
+func (kv *KV) setDerived(loc string, ring *keyring) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.derived[loc] = ring
+}
+
+func (kv *KV) resetDerived() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.derived = make(map[string]*keyring)
+}
+
+// legacyKey returns the key of older versions, which had no key providers
+func (kv *KV) legacyKey() string {
+	if len(kv.providers) > 0 {
+		return ""
+	}
+	return toMD5(kv.secret)
+}
+
+// dataKey returns the AES key of a database, key providers take precedence over the secret
+func (kv *KV) dataKey(m *metadata) (string, error) {
+	if m.KDF == "envelope" {
+		if len(kv.providers) == 0 {
+			return "", fmt.Errorf("The database is encrypted with key providers, but none is set")
+		}
+		key, err := m.unwrap(kv.providers)
+		if err != nil {
+			return "", err
+		}
+		return string(key), nil
+	}
+	if len(kv.providers) > 0 {
+		return "", fmt.Errorf("The database is encrypted with a secret, not with key providers")
+	}
+	return m.deriveKey(kv.secret)
+}
+
+func (kv *KV) readMetadata() (*metadata, error) {
+	record, err := kv.fetch(metadataFile)
+	if err != nil {
+		return nil, err
+	}
+	if record.Name == "" {
+		return nil, nil
+	}
+	m := &metadata{}
+	if err := json.Unmarshal([]byte(record.Content), m); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %s", metadataFile, err)
+	}
+	return m, nil
+}
+
+// createMetadata writes new metadata, unless another client was faster
+func (kv *KV) createMetadata() (*metadata, error) {
+	var m *metadata
+	var err error
+	if len(kv.providers) > 0 {
+		m, err = newEnvelopeMetadata(kv.providers)
+	} else {
+		m, err = newMetadata()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(kv.providers) == 0 {
+		// Keys written by older versions stay readable
+		krl, err := kv.querier.Keys()
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		m.Legacy = err == nil && len(*krl) > 0
+	}
+	content, _ := json.MarshalIndent(m, "", "  ")
+	defer kv.forget(metadataFile)
+	if cq, ok := kv.querier.(ConditionalQuerier); ok {
+		_, err = cq.SetIfMatch(metadataFile, string(content), "")
+		if _, ok := err.(*ConflictError); ok {
+			return kv.readMetadata()
+		}
+	} else {
+		_, err = kv.querier.Set(metadataFile, string(content))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// storedNames returns the names a key may be stored under, the first one is
+// the name to write. Without encryption it is the key itself.
+func (kv *KV) storedNames(key string, write bool) ([]string, error) {
+	if !kv.encrypted() {
+		return []string{key}, nil
+	}
+	ring, err := kv.cipherKeys(write)
+	if err != nil {
+		return nil, err
+	}
+	return ring.names(key), nil
+}
+
+// encryptKey returns the name a key is written to
+func (kv *KV) encryptKey(key string) (string, error) {
+	names, err := kv.storedNames(key, true)
+	if err != nil {
+		return "", err
+	}
+	return names[0], nil
+}
+
+// encryptValue seals the value written to the stored name of a key
+func (kv *KV) encryptValue(name string, value string) (string, error) {
+	if !kv.encrypted() {
+		return value, nil
+	}
+	ring, err := kv.cipherKeys(true)
+	if err != nil {
+		return "", err
+	}
+	return ring.seal(name, value)
+}
+
+// decryptValue opens the content of a key read from the stored name, an
+// empty content stays empty
+func (kv *KV) decryptValue(key string, name string, value string) (string, error) {
+	if !kv.encrypted() || value == "" {
+		return value, nil
+	}
+	ring, err := kv.cipherKeys(false)
+	if err != nil {
+		return "", err
+	}
+	plain, err := ring.open(name, value)
+	if err != nil {
+		return "", fmt.Errorf("Decrypt key \"%s\" failed: %s", key, err)
+	}
+	return plain, nil
+}
+
+// decryptName returns the key a stored name belongs to, and the position of
+// the name in storedNames of the key, a lower one is read first. Names are
+// deterministic, a name which does not encrypt back to stored was decrypted
+// with a wrong key. The legacy format is not authenticated and always encrypts
+// back, a wrong key is told by the binary name it gives instead.
+func (kv *KV) decryptName(stored string, ring *keyring) (string, int, error) {
+	if ring.data != "" {
+		if name, err := decrypt(stored, ring.data, ""); err == nil && encryptName(name, ring.data) == stored {
+			return name, 0, nil
+		}
+	}
+	if ring.legacy != "" {
+		name, err := legacyDecrypt(stored, ring.legacy)
+		if err == nil && isPrintable(name) && legacyEncrypt(name, ring.legacy) == stored {
+			return name, len(ring.names(name)) - 1, nil
+		}
+	}
+	return "", 0, errDecrypt
+}
+
+// isPrintable reports whether a name is valid UTF-8 without control characters
+func isPrintable(name string) bool {
+	return utf8.ValidString(name) && strings.IndexFunc(name, unicode.IsControl) == -1
+}